@@ -2,189 +2,907 @@ package main
 
 import (
 	"bufio"
-	"encoding/hex"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/Com4n/task5/matconv"
 )
 
-// Cache structure
-type Cache struct {
-	maxEntries int
-	entries    map[string]string
-	keys       []string
+// Derives the output name for inputFile: compressing appends ".x" and
+// decompressing or auto conversion strips it (or appends ".out" when there is
+// nothing to strip). A ".gz" suffix is kept last so the output stays gzip-compressed.
+func outputName(inputFile string, dir matconv.Direction) string {
+	if name, found := strings.CutSuffix(inputFile, ".gz"); found {
+		return outputName(name, dir) + ".gz"
+	}
+	if dir == matconv.Compress {
+		return inputFile + ".x"
+	}
+	if name, found := strings.CutSuffix(inputFile, ".x"); found {
+		return name
+	}
+	return inputFile + ".out"
 }
 
-// NewCache creates a new cache with a given maximum number of entries
-func NewCache(maxEntries int) *Cache {
-	return &Cache{
-		maxEntries: maxEntries,
-		entries:    make(map[string]string),
-		keys:       make([]string, 0, maxEntries),
+// Expands paths into batch jobs. Directories contribute the regular files
+// directly inside them; outputs go to outDir, or next to each input if empty.
+func batchJobs(paths []string, outDir string, dir matconv.Direction) ([]matconv.FileJob, error) {
+	var inputs []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			inputs = append(inputs, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				inputs = append(inputs, filepath.Join(path, entry.Name()))
+			}
+		}
 	}
+
+	jobs := make([]matconv.FileJob, 0, len(inputs))
+	for _, input := range inputs {
+		output := outputName(input, dir)
+		if outDir != "" {
+			output = filepath.Join(outDir, filepath.Base(output))
+		}
+		jobs = append(jobs, matconv.FileJob{InputFile: input, OutputFile: output})
+	}
+	return jobs, nil
 }
 
-// Get retrieves a value from the cache
-func (c *Cache) Get(key string) (string, bool) {
-	val, exists := c.entries[key]
-	return val, exists
+// Walks root and returns a job for every regular file whose name matches glob.
+// Outputs are written next to their inputs.
+func walkJobs(root, glob string, dir matconv.Direction) ([]matconv.FileJob, error) {
+	var jobs []matconv.FileJob
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if matched, _ := filepath.Match(glob, d.Name()); matched {
+			jobs = append(jobs, matconv.FileJob{InputFile: path, OutputFile: outputName(path, dir)})
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+// Logs the cache hit/miss statistics
+func logStats(stats matconv.CacheStats) {
+	slog.Info("cache stats", "hits", stats.Hits, "misses", stats.Misses, "hit_ratio", stats.HitRatio)
 }
 
-// Set adds a key-value pair to the cache
-func (c *Cache) Set(key, value string) {
-	if _, exists := c.entries[key]; !exists {
-		if len(c.entries) >= c.maxEntries {
-			oldestKey := c.keys[0]
-			c.keys = c.keys[1:]
-			delete(c.entries, oldestKey)
+// version is the release name, set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// Describes the build: the version, Go toolchain and, when recorded, the VCS revision
+func versionString() string {
+	desc := fmt.Sprintf("%s %s", version, runtime.Version())
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return desc
+	}
+	settings := make(map[string]string)
+	for _, s := range info.Settings {
+		settings[s.Key] = s.Value
+	}
+	if rev := settings["vcs.revision"]; rev != "" {
+		desc += " " + rev
+		if settings["vcs.modified"] == "true" {
+			desc += "-dirty"
 		}
-		c.keys = append(c.keys, key)
-		c.entries[key] = value
 	}
+	return desc
 }
 
-// Converts a binary string to its hexadecimal representation
-func binToHex(binStr string) (string, error) {
-	binBytes := make([]byte, (len(binStr)+7)/8)
-	for i := 0; i < len(binStr); i += 8 {
-		var binByte byte
-		for j := 0; j < 8 && i+j < len(binStr); j++ {
-			binByte = binByte<<1 | (binStr[i+j] - '0')
-		}
-		binBytes[i/8] = binByte
+// modes lists the valid values of the -mode flag
+var modes = []string{"compress-cached", "compress-noncached", "decompress-cached", "decompress-noncached", "compress-rle", "decompress-rle", "auto", "verify", "selftest"}
+
+// modeLabels names each conversion mode in the timing line
+var modeLabels = map[string]string{
+	"compress-cached":      "Cached conversion",
+	"compress-noncached":   "Non-cached conversion",
+	"decompress-cached":    "Cached decompression",
+	"decompress-noncached": "Non-cached decompression",
+	"compress-rle":         "Run-length encoding",
+	"decompress-rle":       "Run-length decoding",
+	"auto":                 "Automatic conversion",
+}
+
+// Prints the command line help
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s -mode <mode> -in <input_file> -out <output_file> [-cache-size N]\n", os.Args[0])
+	fmt.Fprintf(out, "       %s -mode <mode> [-out <output_dir>] [-workers N] -in <input_dir_or_file> [input_file ...]\n", os.Args[0])
+	fmt.Fprintf(out, "       %s -mode <mode> -recursive [-glob PATTERN] [-workers N] -in <input_dir>\n", os.Args[0])
+	fmt.Fprintf(out, "       %s -mode verify -in <input_file>\n", os.Args[0])
+	fmt.Fprintf(out, "       %s -mode selftest\n\n", os.Args[0])
+	fmt.Fprintf(out, "Modes: %s\n\nFlags:\n", strings.Join(modes, ", "))
+	flag.PrintDefaults()
+}
+
+// Prints an error followed by the usage text and exits with the flag package's status code
+func usageError(format string, args ...any) {
+	fmt.Fprintf(flag.CommandLine.Output(), format+"\n", args...)
+	flag.Usage()
+	os.Exit(2)
+}
+
+// config holds the parsed command line options
+type config struct {
+	mode          string
+	inputFile     string
+	extraFiles    []string
+	outputFile    string
+	cacheSize     int
+	workers       int
+	lineWorkers   int
+	delimiter     string
+	crlf          bool
+	bufferSize    int
+	format        string
+	lower         bool
+	checksum      bool
+	validateSize  bool
+	report        string
+	reportFile    string
+	recursive     bool
+	glob          string
+	force         bool
+	progress      bool
+	version       bool
+	skipErrors    bool
+	maxErrors     int
+	trim          bool
+	dryRun        bool
+	bench         int
+	statsInterval time.Duration
+	maxLine       int
+	logLevel      slog.Level
+	resume        bool
+	bitOrder      string
+	align         int
+	warm          string
+	countOnly     bool
+	atomic        bool
+	header        bool
+	hashKeys      bool
+	errorsFile    string
+	splitLines    int
+	fsync         bool
+	histogram     int
+	autoCache     bool
+	cachePerSize  bool
+	limit         int
+	outDelim      string
+	dedup         bool
+	comments      bool
+	commentPrefix string
+	keepComments  bool
+	sample        int
+	seed          int64
+	sort          bool
+	null          bool
+	follow        bool
+}
+
+// batch reports whether several files are converted, in which case -out names a directory
+func (cfg config) batch() bool {
+	if cfg.recursive || len(cfg.extraFiles) > 0 {
+		return true
 	}
-	return strings.ToUpper(hex.EncodeToString(binBytes)), nil
+	info, err := os.Stat(cfg.inputFile)
+	return err == nil && info.IsDir()
 }
 
-// Converts a hexadecimal string to its binary representation
-func hexToBin(hexStr string) (string, error) {
-	bytes, err := hex.DecodeString(hexStr)
-	if err != nil {
-		return "", err
+// validGlob reports whether pattern is a well-formed filepath.Match pattern
+func validGlob(pattern string) bool {
+	_, err := filepath.Match(pattern, "")
+	return err == nil
+}
+
+// Parses and validates the command line, exiting with usage on invalid input
+func parseFlags() config {
+	var cfg config
+	flag.Usage = usage
+	flag.StringVar(&cfg.mode, "mode", "", "conversion mode (see Modes above)")
+	flag.StringVar(&cfg.inputFile, "in", "", "input file or directory, or - for stdin")
+	flag.StringVar(&cfg.outputFile, "out", "", "output file, or - for stdout; the output directory when converting several files")
+	flag.IntVar(&cfg.cacheSize, "cache-size", 5000, "maximum number of cached lines; 0 or less is unbounded")
+	flag.IntVar(&cfg.workers, "workers", runtime.NumCPU(), "number of files converted concurrently")
+	flag.IntVar(&cfg.lineWorkers, "line-workers", 1, "number of goroutines converting the lines of each file")
+	flag.StringVar(&cfg.delimiter, "delim", ":", "separator between the size and value fields")
+	flag.BoolVar(&cfg.crlf, "crlf", false, "terminate output lines with CRLF instead of LF")
+	flag.IntVar(&cfg.bufferSize, "buffer-size", 0, "output buffer size in bytes; 0 uses the default")
+	flag.StringVar(&cfg.format, "format", matconv.FormatHex, "value encoding: "+strings.Join(matconv.Formats, ", ")+", or "+matconv.FormatRaw+" for a binary file of packed records")
+	flag.BoolVar(&cfg.lower, "lower", false, "emit lowercase hex digits")
+	flag.StringVar(&cfg.report, "report", reportText, "run summary format: text or json")
+	flag.StringVar(&cfg.reportFile, "report-file", "", "write the json report to this file instead of stderr")
+	flag.BoolVar(&cfg.validateSize, "validate-size", false, "require N*N bits for size N (or R*C for RxC), in either direction")
+	flag.BoolVar(&cfg.checksum, "checksum", false, "append a CRC32 field when compressing and verify it when decompressing")
+	flag.BoolVar(&cfg.recursive, "recursive", false, "convert every file under the -in directory whose name matches -glob, writing outputs alongside")
+	flag.StringVar(&cfg.glob, "glob", "*.in", "file name pattern matched by -recursive")
+	flag.BoolVar(&cfg.force, "force", false, "overwrite output files that already exist")
+	flag.BoolVar(&cfg.progress, "progress", false, "periodically print the number of converted lines and the rate to stderr")
+	flag.BoolVar(&cfg.version, "version", false, "print the build version and exit")
+	flag.BoolVar(&cfg.skipErrors, "skip-errors", false, "report lines that fail to convert to stderr, or to -errors, and carry on")
+	flag.IntVar(&cfg.maxErrors, "max-errors", 0, "with -skip-errors, exit non-zero only when more lines than this were skipped")
+	flag.BoolVar(&cfg.trim, "trim", false, "trim whitespace around fields and ignore blank lines")
+	flag.BoolVar(&cfg.dryRun, "dry-run", false, "convert and report errors without writing any output")
+	flag.IntVar(&cfg.bench, "bench", 0, "repeat the conversion N times and report the average time and throughput")
+	flag.DurationVar(&cfg.statsInterval, "stats-interval", 0, "print running cache statistics to stderr at this interval, e.g. 5s")
+	flag.IntVar(&cfg.maxLine, "max-line", 0, "longest accepted input line in bytes; 0 keeps the 64KiB default")
+	flag.TextVar(&cfg.logLevel, "log-level", slog.LevelInfo, "minimum level logged to stderr: debug, info, warn or error")
+	flag.BoolVar(&cfg.resume, "resume", false, "continue an interrupted run by appending to an existing output file")
+	flag.StringVar(&cfg.bitOrder, "bit-order", bitOrderMSB, "bit packing order within each byte: msb or lsb first")
+	flag.IntVar(&cfg.align, "align", 1, "pad each packed value with zero bytes to a multiple of this many bytes")
+	flag.StringVar(&cfg.warm, "warm", "", "preload the cache from a file of input lines or \"input -> converted\" pairs")
+	flag.BoolVar(&cfg.countOnly, "count-only", false, "report line, size and bit length statistics of -in without converting; -mode is not needed")
+	flag.BoolVar(&cfg.atomic, "atomic", false, "write to a temporary file and rename it over the output on success; an interrupted run then leaves nothing to -resume")
+	flag.BoolVar(&cfg.header, "header", false, "start compressed output with a line describing the format; decompression always honors one")
+	flag.BoolVar(&cfg.hashKeys, "hash-keys", false, "store a 64-bit hash of each input line in the cache instead of the line itself")
+	flag.StringVar(&cfg.errorsFile, "errors", "", "with -skip-errors, write the skipped lines to this file instead of stderr")
+	flag.IntVar(&cfg.splitLines, "split-lines", 0, "write each output as numbered chunks (out.000, out.001, ...) of at most N lines")
+	flag.BoolVar(&cfg.fsync, "fsync", false, "sync output files to disk before closing them")
+	flag.IntVar(&cfg.histogram, "histogram", 0, "with -count-only, print how many lines have each number of set bits, in buckets of N")
+	flag.BoolVar(&cfg.autoCache, "auto-cache", false, "in cached modes, stop caching inputs whose first lines rarely repeat")
+	flag.BoolVar(&cfg.cachePerSize, "cache-per-size", false, "share the cache size between matrix sizes, evicting from the size holding the most lines")
+	flag.IntVar(&cfg.limit, "limit", 0, "stop after converting this many lines of each input; 0 or less converts everything")
+	flag.StringVar(&cfg.outDelim, "out-delim", "", "separator between the fields of output lines; empty uses -delim")
+	flag.BoolVar(&cfg.dedup, "dedup", false, "write only the first occurrence of each converted line and report how many repeats were dropped")
+	flag.BoolVar(&cfg.comments, "comments", false, "ignore empty lines and lines starting with -comment-prefix")
+	flag.StringVar(&cfg.commentPrefix, "comment-prefix", "#", "prefix of the comment lines ignored by -comments")
+	flag.BoolVar(&cfg.keepComments, "keep-comments", false, "copy the lines ignored by -comments or -trim to the output unchanged")
+	flag.IntVar(&cfg.sample, "sample", 0, "write a uniform random sample of this many converted lines of each input, in input order")
+	flag.Int64Var(&cfg.seed, "seed", 0, "random seed of -sample, for a reproducible sample; 0 picks one at random")
+	flag.BoolVar(&cfg.sort, "sort", false, "write the converted lines of each input ordered by matrix size; holds them all in memory")
+	flag.BoolVar(&cfg.null, "null", false, "read and write records separated by NUL bytes instead of newlines")
+	flag.BoolVar(&cfg.follow, "follow", false, "keep converting lines appended to -in, like tail -f, until interrupted")
+	flag.Parse()
+	cfg.extraFiles = flag.Args()
+
+	if cfg.version {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+
+	formatOpts := matconv.Options{Format: cfg.format, Checksum: cfg.checksum}
+	if strings.HasSuffix(cfg.mode, "-rle") {
+		formatOpts.Format = matconv.FormatRLE
 	}
-	binStr := ""
-	for _, b := range bytes {
-		binStr += fmt.Sprintf("%08b", b)
+	delimErr := matconv.CheckDelimiter(cfg.delimiter, formatOpts)
+	var outDelimErr error
+	if cfg.outDelim != "" {
+		outDelimErr = matconv.CheckDelimiter(cfg.outDelim, formatOpts)
 	}
-	return binStr, nil
+	switch {
+	case cfg.mode == "" && !cfg.countOnly:
+		usageError("missing -mode")
+	case cfg.mode != "" && !slices.Contains(modes, cfg.mode):
+		usageError("unknown mode %q", cfg.mode)
+	case cfg.mode == "selftest":
+		// needs no input or output
+	case cfg.inputFile == "":
+		usageError("missing -in")
+	case (cfg.mode == "verify" || cfg.countOnly) && len(cfg.extraFiles) > 0:
+		usageError("verify and -count-only take a single input file")
+	case cfg.workers < 1:
+		usageError("-workers must be at least 1")
+	case cfg.delimiter == "":
+		usageError("-delim must not be empty")
+	case !slices.Contains(matconv.Formats, cfg.format) && cfg.format != matconv.FormatRaw:
+		usageError("unknown format %q", cfg.format)
+	case delimErr != nil:
+		usageError("-delim: %v", delimErr)
+	case outDelimErr != nil:
+		usageError("-out-delim: %v", outDelimErr)
+	case cfg.format == matconv.FormatRaw && (cfg.mode == "verify" || cfg.resume || cfg.splitLines > 0 || cfg.header):
+		usageError("-format raw writes a binary file and cannot be combined with verify, -resume, -split-lines or -header")
+	case cfg.warm != "" && !strings.HasSuffix(cfg.mode, "-cached"):
+		usageError("-warm needs a cached mode")
+	case cfg.autoCache && !strings.HasSuffix(cfg.mode, "-cached"):
+		usageError("-auto-cache needs a cached mode")
+	case cfg.cachePerSize && cfg.hashKeys:
+		usageError("-cache-per-size cannot be combined with -hash-keys")
+	case cfg.align < 1:
+		usageError("-align must be at least 1")
+	case cfg.bitOrder != bitOrderMSB && cfg.bitOrder != bitOrderLSB:
+		usageError("unknown bit order %q", cfg.bitOrder)
+	case cfg.report != reportText && cfg.report != reportJSON:
+		usageError("unknown report format %q", cfg.report)
+	case cfg.recursive && (cfg.mode == "verify" || len(cfg.extraFiles) > 0 || cfg.outputFile != ""):
+		usageError("-recursive takes a single -in directory and no -out")
+	case !validGlob(cfg.glob):
+		usageError("invalid -glob pattern %q", cfg.glob)
+	case cfg.bench > 1 && (cfg.inputFile == matconv.Stdio || cfg.outputFile == matconv.Stdio):
+		usageError("-bench repeats the run and needs file input and output")
+	case cfg.splitLines < 0:
+		usageError("-split-lines must not be negative")
+	case cfg.splitLines > 0 && (cfg.resume || cfg.outputFile == matconv.Stdio):
+		usageError("-split-lines writes chunk files and cannot be combined with -resume or stdout output")
+	case cfg.histogram < 0 || (cfg.histogram > 0 && !cfg.countOnly):
+		usageError("-histogram takes a positive bucket width and needs -count-only")
+	case cfg.errorsFile != "" && !cfg.skipErrors:
+		usageError("-errors needs -skip-errors")
+	case cfg.resume && (cfg.skipErrors || cfg.trim || cfg.dedup || cfg.comments):
+		usageError("-resume needs one output line per input line and cannot be combined with -skip-errors, -trim, -dedup or -comments")
+	case cfg.comments && cfg.commentPrefix == "":
+		usageError("-comment-prefix must not be empty")
+	case cfg.keepComments && !cfg.comments && !cfg.trim:
+		usageError("-keep-comments needs -comments or -trim")
+	case (cfg.dedup || cfg.sample > 0 || cfg.sort) && cfg.format == matconv.FormatRaw:
+		usageError("-dedup, -sample and -sort cannot be combined with -format raw")
+	case cfg.sort && cfg.resume:
+		usageError("-sort cannot be combined with -resume")
+	case cfg.follow && (cfg.batch() || cfg.mode == "verify" || cfg.countOnly || cfg.bench > 1 || cfg.sort || cfg.sample > 0 || cfg.format == matconv.FormatRaw):
+		usageError("-follow converts a single input as it grows and cannot be combined with verify, -count-only, -bench, -sort, -sample or -format raw")
+	case cfg.null && (cfg.crlf || cfg.resume || cfg.splitLines > 0):
+		usageError("-null cannot be combined with -crlf, -resume or -split-lines")
+	case cfg.sample < 0 || (cfg.sample > 0 && cfg.resume):
+		usageError("-sample takes a positive line count and cannot be combined with -resume")
+	case cfg.outputFile == "" && cfg.mode != "verify" && !cfg.batch() && !cfg.dryRun && !cfg.countOnly:
+		usageError("missing -out")
+	}
+	return cfg
 }
 
-// Converts mat.in to mat.in.x using caching
-func convertWithCache(inputFile, outputFile string, cache *Cache) error {
-	input, err := os.Open(inputFile)
-	if err != nil {
-		return err
+// Runs the selected mode; the timing line is only logged when it succeeds
+func run(ctx context.Context, cfg config) error {
+	opts := matconv.Options{
+		Direction:       matconv.Compress,
+		LineWorkers:     cfg.lineWorkers,
+		Delimiter:       cfg.delimiter,
+		CRLF:            cfg.crlf,
+		BufferSize:      cfg.bufferSize,
+		Format:          cfg.format,
+		LowerHex:        cfg.lower,
+		Checksum:        cfg.checksum,
+		ValidateSize:    cfg.validateSize,
+		NoClobber:       !cfg.force,
+		SkipErrors:      cfg.skipErrors,
+		OnSkip:          func(err error) { slog.Warn("skipped line", "err", err) },
+		TrimSpace:       cfg.trim,
+		DryRun:          cfg.dryRun,
+		MaxLineSize:     cfg.maxLine,
+		Resume:          cfg.resume,
+		LSBFirst:        cfg.bitOrder == bitOrderLSB,
+		Align:           cfg.align,
+		Atomic:          cfg.atomic,
+		Header:          cfg.header,
+		SplitLines:      cfg.splitLines,
+		Sync:            cfg.fsync,
+		Limit:           cfg.limit,
+		OutputDelimiter: cfg.outDelim,
+		Dedup:           cfg.dedup,
+		KeepComments:    cfg.keepComments,
+		Sample:          cfg.sample,
+		Seed:            cfg.seed,
+		SortBySize:      cfg.sort,
+		Follow:          cfg.follow,
+	}
+	if cfg.null {
+		opts.Split, opts.RecordSeparator = matconv.ScanNull, "\x00"
+	}
+	if cfg.sample > 0 && cfg.seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+	if cfg.comments {
+		opts.CommentPrefix = cfg.commentPrefix
+	}
+	if strings.HasPrefix(cfg.mode, "decompress") {
+		opts.Direction = matconv.Decompress
+	}
+	if cfg.autoCache {
+		opts.AutoCache = autoCacheSample
+	}
+	if cfg.mode == "auto" {
+		opts.Direction = matconv.Auto
+	}
+	if strings.HasSuffix(cfg.mode, "-rle") {
+		opts.Format = matconv.FormatRLE
 	}
-	defer input.Close()
 
-	output, err := os.Create(outputFile)
-	if err != nil {
-		return err
+	if cfg.mode == "selftest" {
+		vectors, err := matconv.SelfTest()
+		if err != nil {
+			return fmt.Errorf("self-test failed:\n%w", err)
+		}
+		slog.Info("self-test passed", "vectors", vectors)
+		return nil
 	}
-	defer output.Close()
 
-	scanner := bufio.NewScanner(input)
-	writer := bufio.NewWriter(output)
+	if cfg.countOnly {
+		counts, err := matconv.CountFile(cfg.inputFile, opts)
+		if err != nil {
+			return err
+		}
+		slog.Info("counted", "lines", counts.Lines, "malformed", counts.Malformed, "distinct_sizes", counts.Sizes,
+			"min_bits", counts.MinBits, "avg_bits", counts.AvgBits, "max_bits", counts.MaxBits)
+		if cfg.histogram > 0 {
+			return writeHistogram(os.Stdout, counts.Histogram(cfg.histogram))
+		}
+		return nil
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if cachedValue, found := cache.Get(line); found {
-			writer.WriteString(cachedValue + "\n")
+	if cfg.mode == "verify" {
+		lines, mismatches, err := matconv.VerifyFile(cfg.inputFile, opts)
+		if err != nil {
+			return err
+		}
+		slog.Info("verified", "lines", lines, "mismatches", mismatches)
+		if mismatches > 0 {
+			return fmt.Errorf("%d of %d lines failed to round-trip", mismatches, lines)
+		}
+		return nil
+	}
+
+	if cfg.errorsFile != "" {
+		errLog, err := createErrorLog(cfg.errorsFile)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := errLog.close(); err != nil {
+				slog.Error("writing skipped lines", "file", cfg.errorsFile, "err", err)
+			}
+		}()
+		opts.OnSkip = errLog.record
+	}
+
+	var progress *progressMeter
+	if cfg.progress {
+		progress = newProgressMeter(os.Stderr)
+		opts.Progress = progress.add
+	}
+
+	var jobs []matconv.FileJob
+	if cfg.batch() {
+		var err error
+		if cfg.recursive {
+			jobs, err = walkJobs(cfg.inputFile, cfg.glob, opts.Direction)
 		} else {
-			parts := strings.Split(line, ":")
-			matrixSize := parts[0]
-			binaryStr := parts[1]
+			jobs, err = batchJobs(append([]string{cfg.inputFile}, cfg.extraFiles...), cfg.outputFile, opts.Direction)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	files := max(len(jobs), 1)
 
-			hexStr, err := binToHex(binaryStr)
-			if err != nil {
-				return err
+	var stats *statsLogger
+	var newCache func() *matconv.Cache[string]
+	// The caches of the current run, one per batch worker, for the merged statistics
+	var runCaches []*matconv.Cache[string]
+	var runCachesMu sync.Mutex
+	if strings.HasSuffix(cfg.mode, "-cached") {
+		// Warm one cache and copy it into each new one, in eviction order
+		var seed *matconv.Cache[string]
+		if cfg.warm != "" {
+			seed = matconv.NewCache[string](cfg.cacheSize)
+			if _, err := matconv.WarmCacheFile(seed, cfg.warm, opts); err != nil {
+				return fmt.Errorf("warming cache from %s: %w", cfg.warm, err)
+			}
+		}
+		if cfg.statsInterval > 0 {
+			stats = startStatsLogger(cfg.statsInterval)
+		}
+		newCache = func() *matconv.Cache[string] {
+			cache := matconv.NewCache[string](cfg.cacheSize)
+			if cfg.hashKeys {
+				cache = matconv.NewHashedCache[string](cfg.cacheSize, nil)
+			}
+			if cfg.cachePerSize {
+				cache = matconv.NewCacheWithPolicy[string](cfg.cacheSize, matconv.NewPartitionedPolicy(matconv.PartitionBySize(opts), matconv.NewLRUPolicy))
 			}
-			newLine := fmt.Sprintf("%s:%s", matrixSize, hexStr)
-			cache.Set(line, newLine)
-			writer.WriteString(newLine + "\n")
+			if seed != nil {
+				for _, key := range seed.Keys() {
+					value, _ := seed.Peek(key)
+					cache.Set(key, value)
+				}
+			}
+			if stats != nil {
+				stats.watch(cache)
+			}
+			runCachesMu.Lock()
+			runCaches = append(runCaches, cache)
+			runCachesMu.Unlock()
+			return cache
 		}
 	}
-	writer.Flush()
-	return scanner.Err()
-}
 
-// Converts mat.in to mat.in.x without caching
-func convertWithoutCache(inputFile, outputFile string) error {
-	input, err := os.Open(inputFile)
-	if err != nil {
-		return err
+	// -bench repeats the whole run with fresh caches and averages the time
+	runs := max(cfg.bench, 1)
+	var summary matconv.Summary
+	var err error
+	var total time.Duration
+	completed := 0
+	for completed < runs && err == nil {
+		if completed > 0 {
+			opts.NoClobber = false
+		}
+		runCaches = nil
+		if stats != nil {
+			stats.reset()
+		}
+		start := time.Now()
+		summary, err = convertOnce(ctx, cfg, jobs, newCache, opts)
+		total += time.Since(start)
+		completed++
+	}
+	// Following only ends with an interrupt, which is then a clean exit
+	if cfg.follow && errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	if stats != nil {
+		stats.stop()
+	}
+	elapsed := total / time.Duration(completed)
+	if progress != nil {
+		progress.finish()
+	}
+	var cacheStats *matconv.CacheStats
+	if newCache != nil {
+		merged := matconv.MergeStats(runCaches...)
+		cacheStats = &merged
+	}
+	if err == nil && summary.Errors > cfg.maxErrors {
+		err = fmt.Errorf("skipped %d lines, more than -max-errors %d", summary.Errors, cfg.maxErrors)
 	}
-	defer input.Close()
 
-	output, err := os.Create(outputFile)
+	if cfg.report == reportJSON {
+		if reportErr := writeJSONReport(cfg, summary, cacheStats, elapsed, err); reportErr != nil {
+			return errors.Join(err, reportErr)
+		}
+		return err
+	}
+	if cfg.batch() {
+		slog.Info("files converted", "converted", files-summary.FailedFiles, "failed", summary.FailedFiles)
+	}
+	if cfg.dryRun {
+		slog.Info("dry run, nothing written", "lines", summary.Lines, "errors", summary.Errors)
+	}
 	if err != nil {
 		return err
 	}
-	defer output.Close()
+	slog.Info(modeLabels[cfg.mode]+" finished", "files", files, "lines", summary.Lines, "seconds", elapsed.Seconds(),
+		"input_bytes", summary.InputBytes, "output_bytes", summary.OutputBytes, "ratio", summary.Ratio())
+	if cfg.bench > 0 {
+		seconds := max(elapsed.Seconds(), 1e-9)
+		slog.Info("throughput", "runs", runs,
+			"lines_per_second", float64(summary.Lines)/seconds, "bytes_per_second", float64(inputBytes(cfg, jobs))/seconds)
+	}
+	if cfg.dedup {
+		slog.Info("duplicates dropped", "lines", summary.Duplicates)
+	}
+	if cfg.sample > 0 {
+		slog.Info("sampled", "lines", summary.Lines, "seed", opts.Seed)
+	}
+	if summary.Uncached > 0 {
+		slog.Info("cache bypassed", "files", summary.Uncached, "reason", "few repeated lines")
+	}
+	if cacheStats != nil {
+		logStats(*cacheStats)
+	}
+	return nil
+}
 
-	scanner := bufio.NewScanner(input)
-	writer := bufio.NewWriter(output)
+// autoCacheSample is how many lines -auto-cache samples at the start of each input
+const autoCacheSample = 4096
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ":")
-		matrixSize := parts[0]
-		binaryStr := parts[1]
+// Writes one "low-high<TAB>lines" row per set-bit bucket
+func writeHistogram(w io.Writer, buckets []matconv.Bucket) error {
+	out := bufio.NewWriter(w)
+	for _, b := range buckets {
+		fmt.Fprintf(out, "%d-%d\t%d\n", b.Low, b.High, b.Lines)
+	}
+	return out.Flush()
+}
 
-		hexStr, err := binToHex(binaryStr)
-		if err != nil {
-			return err
+// Converts the input once, either the batch jobs or the single -in file. newCache
+// is nil for the non-cached modes. Canceling ctx stops the conversion.
+func convertOnce(ctx context.Context, cfg config, jobs []matconv.FileJob, newCache func() *matconv.Cache[string], opts matconv.Options) (matconv.Summary, error) {
+	switch {
+	case cfg.batch():
+		return matconv.ConvertFilesContext(ctx, jobs, cfg.workers, newCache, opts)
+	case newCache != nil:
+		return matconv.ConvertFileContext(ctx, cfg.inputFile, cfg.outputFile, newCache(), opts)
+	default:
+		return matconv.ConvertFileContext(ctx, cfg.inputFile, cfg.outputFile, nil, opts)
+	}
+}
+
+// Sums the sizes of the input files, skipping any that cannot be stat'ed
+func inputBytes(cfg config, jobs []matconv.FileJob) int64 {
+	paths := []string{cfg.inputFile}
+	if jobs != nil {
+		paths = paths[:0]
+		for _, job := range jobs {
+			paths = append(paths, job.InputFile)
+		}
+	}
+	var total int64
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			total += info.Size()
 		}
-		newLine := fmt.Sprintf("%s:%s", matrixSize, hexStr)
-		writer.WriteString(newLine + "\n")
 	}
-	writer.Flush()
-	return scanner.Err()
+	return total
 }
 
-func main() {
-	if len(os.Args) < 4 {
-		fmt.Println("Usage: <mode> <input_file> <output_file> <cache_size>")
-		return
+// statsLogger periodically logs the combined statistics of the caches it watches
+type statsLogger struct {
+	mu     sync.Mutex
+	caches []*matconv.Cache[string]
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Starts logging every interval until stop is called
+func startStatsLogger(interval time.Duration) *statsLogger {
+	l := &statsLogger{done: make(chan struct{})}
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.print()
+			case <-l.done:
+				return
+			}
+		}
+	}()
+	return l
+}
+
+// Adds cache to the statistics; safe to call while the logger runs
+func (l *statsLogger) watch(cache *matconv.Cache[string]) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.caches = append(l.caches, cache)
+}
+
+// Forgets the watched caches, so each -bench run logs only its own
+func (l *statsLogger) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.caches = nil
+}
+
+// Stops the logger and waits for any log call in progress
+func (l *statsLogger) stop() {
+	close(l.done)
+	l.wg.Wait()
+}
+
+// Logs the summed hits, misses and sizes of the watched caches
+func (l *statsLogger) print() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var size int
+	for _, cache := range l.caches {
+		size += cache.Len()
+	}
+	stats := matconv.MergeStats(l.caches...)
+	slog.Info("cache stats", "hits", stats.Hits, "misses", stats.Misses, "hit_ratio", stats.HitRatio, "size", size)
+}
+
+// progressMeter prints a running line count and rate for -progress. add is safe to
+// call from the concurrent conversions of a batch.
+type progressMeter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	lines   int
+	start   time.Time
+	printed time.Time
+}
+
+// Creates a meter that writes to w, timing from now
+func newProgressMeter(w io.Writer) *progressMeter {
+	now := time.Now()
+	return &progressMeter{w: w, start: now, printed: now}
+}
+
+// Counts newly converted lines, printing at most once a second
+func (p *progressMeter) add(lines int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lines += lines
+	if now := time.Now(); now.Sub(p.printed) >= time.Second {
+		p.printed = now
+		p.print(now)
 	}
+}
+
+// Prints the final count and ends the progress line
+func (p *progressMeter) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.print(time.Now())
+	fmt.Fprintln(p.w)
+}
+
+// Writes the current count and average rate over the previous progress line
+func (p *progressMeter) print(now time.Time) {
+	rate := float64(p.lines) / max(now.Sub(p.start).Seconds(), 1e-9)
+	fmt.Fprintf(p.w, "\r%d lines, %.0f lines/s", p.lines, rate)
+}
+
+// errorLog writes the lines dropped by -skip-errors to the -errors file, one
+// record per line. record is safe to call from the concurrent conversions of a batch.
+type errorLog struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
 
-	mode := os.Args[1]
-	inputFile := os.Args[2]
-	outputFile := os.Args[3]
-	cacheSize := 5000 // Default cache size
-	if len(os.Args) >= 5 {
-		fmt.Sscanf(os.Args[4], "%d", &cacheSize)
+// Creates the error file at path, truncating any previous one
+func createErrorLog(path string) (*errorLog, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
 	}
+	return &errorLog{file: file, w: bufio.NewWriter(file)}, nil
+}
 
-	cache := NewCache(cacheSize)
+// Writes the error of a skipped line followed by a tab and the quoted line content
+func (l *errorLog) record(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var lineErr *matconv.LineError
+	if errors.As(err, &lineErr) {
+		fmt.Fprintf(l.w, "%v\t%q\n", err, lineErr.Content)
+		return
+	}
+	fmt.Fprintln(l.w, err)
+}
 
-	switch mode {
-	case "compress-cached":
-		start := time.Now()
-		if err := convertWithCache(inputFile, outputFile, cache); err != nil {
-			fmt.Println("Error:", err)
-		}
-		fmt.Printf("Cached conversion took %.2f seconds\n", time.Since(start).Seconds())
-	case "compress-noncached":
-		start := time.Now()
-		if err := convertWithoutCache(inputFile, outputFile); err != nil {
-			fmt.Println("Error:", err)
-		}
-		fmt.Printf("Non-cached conversion took %.2f seconds\n", time.Since(start).Seconds())
-	case "decompress-cached":
-		start := time.Now()
-		if err := convertWithCache(inputFile, outputFile, cache); err != nil {
-			fmt.Println("Error:", err)
+// Flushes the buffered records and closes the file
+func (l *errorLog) close() error {
+	return errors.Join(l.w.Flush(), l.file.Close())
+}
+
+// Bit orders for the -bit-order flag
+const (
+	bitOrderMSB = "msb"
+	bitOrderLSB = "lsb"
+)
+
+// Report formats for the -report flag
+const (
+	reportText = "text"
+	reportJSON = "json"
+)
+
+// runReport is the machine-readable summary written by -report json
+type runReport struct {
+	Mode           string              `json:"mode"`
+	Input          string              `json:"input"`
+	Output         string              `json:"output"`
+	Lines          int                 `json:"lines"`
+	Errors         int                 `json:"errors"`
+	FailedFiles    int                 `json:"failed_files,omitempty"`
+	UncachedFiles  int                 `json:"uncached_files,omitempty"`
+	Duplicates     int                 `json:"duplicates,omitempty"`
+	InputBytes     int64               `json:"input_bytes"`
+	OutputBytes    int64               `json:"output_bytes"`
+	Ratio          float64             `json:"ratio"`
+	ElapsedSeconds float64             `json:"elapsed_seconds"`
+	Cache          *matconv.CacheStats `json:"cache,omitempty"`
+	Error          string              `json:"error,omitempty"`
+	ErrorLine      int                 `json:"error_line,omitempty"`
+	ErrorOffset    *int64              `json:"error_offset,omitempty"`
+}
+
+// Writes the JSON run report to -report-file, or stderr when it is unset
+func writeJSONReport(cfg config, summary matconv.Summary, cacheStats *matconv.CacheStats, elapsed time.Duration, runErr error) error {
+	rep := runReport{
+		Mode:           cfg.mode,
+		Input:          cfg.inputFile,
+		Output:         cfg.outputFile,
+		Lines:          summary.Lines,
+		Errors:         summary.Errors,
+		FailedFiles:    summary.FailedFiles,
+		UncachedFiles:  summary.Uncached,
+		Duplicates:     summary.Duplicates,
+		InputBytes:     summary.InputBytes,
+		OutputBytes:    summary.OutputBytes,
+		Ratio:          summary.Ratio(),
+		ElapsedSeconds: elapsed.Seconds(),
+		Cache:          cacheStats,
+	}
+	if runErr != nil {
+		rep.Error = runErr.Error()
+		rep.Errors = max(rep.Errors, 1)
+		var lineErr *matconv.LineError
+		if errors.As(runErr, &lineErr) {
+			rep.ErrorLine = lineErr.Line
+			if lineErr.Offset >= 0 {
+				rep.ErrorOffset = &lineErr.Offset
+			}
 		}
-		fmt.Printf("Cached decompression took %.2f seconds\n", time.Since(start).Seconds())
-	case "decompress-noncached":
-		start := time.Now()
-		if err := convertWithoutCache(inputFile, outputFile); err != nil {
-			fmt.Println("Error:", err)
+	}
+	data, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if cfg.reportFile == "" {
+		_, err = os.Stderr.Write(data)
+		return err
+	}
+	return os.WriteFile(cfg.reportFile, data, 0o644)
+}
+
+// Returns a text logger writing records at level and above to w
+func newLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// Returns a context canceled on the first SIGINT or SIGTERM, and a function reporting
+// the signal that canceled it, if any
+func notifyInterrupt() (context.Context, func() os.Signal) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	var caught atomic.Value
+	go func() {
+		sig := <-sigs
+		caught.Store(sig)
+		slog.Warn("interrupted, stopping", "signal", sig)
+		cancel()
+		// A second signal falls back to the default behavior and kills the process
+		signal.Stop(sigs)
+	}()
+	return ctx, func() os.Signal {
+		sig, _ := caught.Load().(os.Signal)
+		return sig
+	}
+}
+
+func main() {
+	cfg := parseFlags()
+	// Logs go to stderr so that stdout only carries converted data
+	slog.SetDefault(newLogger(os.Stderr, cfg.logLevel))
+	// An interrupt cancels the conversion, which flushes the lines converted so far
+	// (or, with -atomic, discards them) and closes the outputs before exiting
+	ctx, interrupted := notifyInterrupt()
+	if err := run(ctx, cfg); err != nil {
+		if sig, ok := interrupted().(syscall.Signal); ok {
+			slog.Error("run interrupted", "err", err)
+			os.Exit(128 + int(sig))
 		}
-		fmt.Printf("Non-cached decompression took %.2f seconds\n", time.Since(start).Seconds())
-	default:
-		fmt.Println("Unknown mode. Use 'compress-cached', 'compress-noncached', 'decompress-cached', or 'decompress-noncached'.")
+		slog.Error("run failed", "err", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,663 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Com4n/task5/matconv"
+)
+
+// TestMain runs main instead of the tests when runMain re-executes the test binary
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv("MATCONV_MAIN_ARGS"); ok {
+		os.Args = append([]string{"matconv"}, strings.Fields(args)...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs main with args in a child process and returns its output and exit code
+func runMain(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "MATCONV_MAIN_ARGS="+strings.Join(args, " "))
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatal(err)
+	}
+	return string(out), cmd.ProcessState.ExitCode()
+}
+
+// parseArgs runs parseFlags over the command line args, as main would
+func parseArgs(t *testing.T, args ...string) config {
+	t.Helper()
+	savedArgs, savedFlags := os.Args, flag.CommandLine
+	t.Cleanup(func() { os.Args, flag.CommandLine = savedArgs, savedFlags })
+	os.Args = append([]string{"matconv"}, args...)
+	flag.CommandLine = flag.NewFlagSet("matconv", flag.ContinueOnError)
+	return parseFlags()
+}
+
+// writeFile creates a file of dir holding data and returns its path
+func writeFile(t *testing.T, dir, name, data string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readFile returns the contents of path, or "" when it cannot be read
+func readFile(path string) string {
+	data, _ := os.ReadFile(path)
+	return string(data)
+}
+
+// syncBuffer is a strings.Builder safe for the concurrent writes of a logger
+type syncBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+// captureLogs sends the default logger to a buffer until the test ends
+func captureLogs(t *testing.T, level slog.Level) *syncBuffer {
+	var buf syncBuffer
+	saved := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(saved) })
+	slog.SetDefault(newLogger(&buf, level))
+	return &buf
+}
+
+// Checks that invalid command lines print the usage and exit with status 2
+func TestUsageErrors(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "missing -mode"},
+		{[]string{"-mode", "shrink", "-in", "a", "-out", "b"}, `unknown mode "shrink"`},
+		{[]string{"-mode", "compress-cached", "-out", "b"}, "missing -in"},
+		{[]string{"-mode", "compress-cached", "-in", "a"}, "missing -out"},
+		{[]string{"-mode", "verify", "-in", "a", "extra"}, "verify and -count-only take a single input file"},
+		{[]string{"-mode", "compress-cached", "-in", "a", "-out", "b", "-workers", "0"}, "-workers must be at least 1"},
+		{[]string{"-mode", "compress-cached", "-in", "a", "-out", "b", "-recursive"}, "-recursive takes a single -in directory and no -out"},
+		{[]string{"-mode", "compress-cached", "-in", "a", "-recursive", "-glob", "["}, `invalid -glob pattern "["`},
+		{[]string{"-mode", "compress-cached", "-in", "a", "-out", "b", "-delim", "."}, `-delim: delimiter "." contains '.', which occurs in hex values`},
+		{[]string{"-mode", "compress-cached", "-in", "a", "-out", "b", "-format", "rle", "-delim", ","}, `-delim: delimiter "," contains ',', which occurs in rle values`},
+		{[]string{"-mode", "decompress-rle", "-in", "a", "-out", "b", "-delim", "x"}, `-delim: delimiter "x" contains 'x', which occurs in rle values`},
+		{[]string{"-mode", "compress-rle", "-in", "a", "-out", "b", "-out-delim", ","}, `-out-delim: delimiter "," contains ',', which occurs in rle values`},
+		{[]string{"-mode", "compress-cached", "-in", "a", "-out", "b", "-bit-order", "middle"}, `unknown bit order "middle"`},
+		{[]string{"-mode", "compress-cached", "-in", "a", "-out", "b", "-align", "0"}, "-align must be at least 1"},
+		{[]string{"-mode", "compress-noncached", "-in", "a", "-out", "b", "-warm", "w"}, "-warm needs a cached mode"},
+		{[]string{"-mode", "compress-noncached", "-in", "a", "-out", "b", "-auto-cache"}, "-auto-cache needs a cached mode"},
+		{[]string{"-mode", "compress-cached", "-in", "a", "-out", "b", "-cache-per-size", "-hash-keys"}, "-cache-per-size cannot be combined with -hash-keys"},
+		{[]string{"-mode", "compress-noncached", "-in", "a", "-out", "b", "-keep-comments"}, "-keep-comments needs -comments or -trim"},
+		{[]string{"-mode", "compress-noncached", "-in", "a", "-out", "b", "-sample", "5", "-resume"}, "-sample takes a positive line count and cannot be combined with -resume"},
+		{[]string{"-mode", "compress-noncached", "-in", "a", "-out", "b", "-null", "-crlf"}, "-null cannot be combined with -crlf, -resume or -split-lines"},
+		{[]string{"-mode", "compress-noncached", "-in", "a", "-out", "b", "-follow", "-sort"}, "-follow converts a single input as it grows and cannot be combined with verify, -count-only, -bench, -sort, -sample or -format raw"},
+		{[]string{"-mode", "compress-noncached", "-in", "a", "-out", "b", "-format", "raw", "-header"}, "-format raw writes a binary file and cannot be combined with verify, -resume, -split-lines or -header"},
+		{[]string{"-mode", "compress-cached", "-in", "a", "-out", "b", "-errors", "e"}, "-errors needs -skip-errors"},
+		{[]string{"-mode", "compress-cached", "-in", "a", "-out", "-", "-split-lines", "5"}, "-split-lines writes chunk files and cannot be combined with -resume or stdout output"},
+		{[]string{"-mode", "compress-cached", "-in", "a", "-out", "b", "-histogram", "2"}, "-histogram takes a positive bucket width and needs -count-only"},
+		{[]string{"-mode", "compress-cached", "-in", "-", "-out", "b", "-bench", "2"}, "-bench repeats the run and needs file input and output"},
+		{[]string{"-mode", "compress-cached", "-in", "a", "-out", "b", "-resume", "-trim"}, "-resume needs one output line per input line and cannot be combined with -skip-errors, -trim, -dedup or -comments"},
+	}
+	for _, tt := range tests {
+		out, code := runMain(t, tt.args...)
+		if code != 2 || !strings.HasPrefix(out, tt.want+"\n") || !strings.Contains(out, "Modes: compress-cached") {
+			t.Errorf("%v: exit %d with %q, want 2 with %q and the usage", tt.args, code, out, tt.want)
+		}
+	}
+}
+
+// Checks the flag defaults, which must leave an interrupted run resumable
+func TestFlagDefaults(t *testing.T) {
+	cfg := parseArgs(t, "-mode", "compress-cached", "-in", "a", "-out", "b")
+	if cfg.atomic {
+		t.Error("-atomic defaults to true, so an interrupted run leaves nothing to -resume")
+	}
+	if cfg.cacheSize != 5000 || cfg.delimiter != ":" || cfg.format != matconv.FormatHex || cfg.align != 1 || cfg.lineWorkers != 1 {
+		t.Errorf("unexpected defaults %+v", cfg)
+	}
+}
+
+// Checks that a failed conversion or verification exits with status 1 and reports the error
+func TestExitStatus(t *testing.T) {
+	dir := t.TempDir()
+	good, bad := filepath.Join(dir, "good"), filepath.Join(dir, "bad")
+	os.WriteFile(good, []byte("2x4:10110011\n"), 0o644)
+	os.WriteFile(bad, []byte("2x4:10110011\n2x4:1011x011\n"), 0o644)
+	tests := []struct {
+		args []string
+		code int
+		want string
+	}{
+		{[]string{"-mode", "compress-noncached", "-in", good, "-out", filepath.Join(dir, "out")}, 0, "Non-cached conversion finished"},
+		{[]string{"-mode", "compress-cached", "-in", filepath.Join(dir, "missing"), "-out", filepath.Join(dir, "out")}, 1, `err="open`},
+		{[]string{"-mode", "compress-cached", "-in", bad, "-out", filepath.Join(dir, "bad.x")}, 1, `err="line 2 (byte 13): invalid binary character`},
+		{[]string{"-mode", "verify", "-in", bad}, 1, `err="1 of 2 lines failed to round-trip"`},
+	}
+	for _, tt := range tests {
+		out, code := runMain(t, tt.args...)
+		if code != tt.code || !strings.Contains(out, tt.want) {
+			t.Errorf("%v: exit %d with %q, want %d with %q", tt.args, code, out, tt.code, tt.want)
+		}
+		if tt.code != 0 && strings.Contains(out, "finished") {
+			t.Errorf("%v: printed the timing of a failed run: %q", tt.args, out)
+		}
+	}
+}
+
+// Checks the output names of a batch and the files a directory contributes
+func TestConvertFiles(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		dir  matconv.Direction
+		want string
+	}{{"m1", matconv.Compress, "m1.x"}, {"m1.x", matconv.Decompress, "m1"}, {"m1", matconv.Decompress, "m1.out"}, {"m1.gz", matconv.Compress, "m1.x.gz"}, {"m1.x.gz", matconv.Decompress, "m1.gz"}} {
+		if got := outputName(tt.in, tt.dir); got != tt.want {
+			t.Errorf("outputName(%q, %v) = %q, want %q", tt.in, tt.dir, got, tt.want)
+		}
+	}
+	in, out := t.TempDir(), t.TempDir()
+	for i := 0; i < 5; i++ {
+		os.WriteFile(filepath.Join(in, fmt.Sprint("m", i)), nil, 0o644)
+	}
+	os.Mkdir(filepath.Join(in, "sub"), 0o755)
+	jobs, err := batchJobs([]string{in, filepath.Join(in, "m0")}, out, matconv.Compress)
+	if err != nil || len(jobs) != 6 {
+		t.Fatalf("batchJobs = %d jobs, %v, want 6", len(jobs), err)
+	}
+	if want := (matconv.FileJob{InputFile: filepath.Join(in, "m0"), OutputFile: filepath.Join(out, "m0.x")}); jobs[0] != want || jobs[5] != want {
+		t.Errorf("batchJobs = %+v, want %+v first and last", jobs, want)
+	}
+}
+
+// Checks that -resume completes the output of an interrupted run
+func TestResume(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := writeFile(t, dir, "in", "3:101\n3:111\n5:10110\n")
+	outputFile := writeFile(t, dir, "out", "3:A0.3\n")
+	if err := run(context.Background(), parseArgs(t, "-mode", "compress-noncached", "-in", inputFile, "-out", outputFile, "-resume")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(outputFile); got != "3:A0.3\n3:E0.3\n5:B0.5\n" {
+		t.Errorf("resumed output %q", got)
+	}
+}
+
+// Checks that the output of an interrupted run completes with -resume
+func TestResumeAfterInterrupt(t *testing.T) {
+	dir := t.TempDir()
+	var in strings.Builder
+	for i := 0; i < 300000; i++ {
+		fmt.Fprintf(&in, "16:%016b\n", i%65536)
+	}
+	inputFile := writeFile(t, dir, "in", in.String())
+	full, partial := filepath.Join(dir, "full"), filepath.Join(dir, "partial")
+	if err := run(context.Background(), parseArgs(t, "-mode", "compress-noncached", "-in", inputFile, "-out", full)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	err := run(ctx, parseArgs(t, "-mode", "compress-noncached", "-in", inputFile, "-out", partial))
+	if !errors.Is(err, context.Canceled) {
+		t.Skipf("run finished before the interrupt: %v", err)
+	}
+	kept := readFile(partial)
+	if kept != "" && !strings.HasSuffix(kept, "\n") {
+		t.Fatal("interrupted output ends mid-line")
+	}
+	if err := run(context.Background(), parseArgs(t, "-mode", "compress-noncached", "-in", inputFile, "-out", partial, "-resume")); err != nil {
+		t.Fatal(err)
+	}
+	if readFile(partial) != readFile(full) {
+		t.Errorf("resumed output differs from a full run after keeping %d bytes", len(kept))
+	}
+}
+
+// Checks that -format raw round-trips through compress and decompress
+func TestRawFormat(t *testing.T) {
+	dir := t.TempDir()
+	in := "2:1011\n3:101010101\n"
+	inputFile := writeFile(t, dir, "in", in)
+	raw, back := filepath.Join(dir, "raw"), filepath.Join(dir, "back")
+	if err := run(context.Background(), parseArgs(t, "-mode", "compress-noncached", "-format", "raw", "-in", inputFile, "-out", raw)); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(context.Background(), parseArgs(t, "-mode", "decompress-noncached", "-format", "raw", "-in", raw, "-out", back)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(back); got != in {
+		t.Errorf("got %q, want %q", got, in)
+	}
+}
+
+// Checks the output of each conversion mode
+func TestModes(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		args []string
+		want string
+	}{
+		{"compress", "3:101\n3:111\n", []string{"-mode", "compress-cached"}, "3:A0.3\n3:E0.3\n"},
+		{"decompress", "3:A0.3\n", []string{"-mode", "decompress-noncached"}, "3:101\n"},
+		{"auto", "3:101\n3:E0.3\n", []string{"-mode", "auto"}, "3:A0.3\n3:111\n"},
+		{"rle", "5:00011\n", []string{"-mode", "compress-rle"}, "5:0x3,1x2\n"},
+		{"rle decode", "5:0x3,1x2\n", []string{"-mode", "decompress-rle"}, "5:00011\n"},
+		{"lsb", "3:101\n", []string{"-mode", "compress-noncached", "-bit-order", "lsb"}, "3:05.3\n"},
+		{"out-delim", "3:101\n", []string{"-mode", "compress-noncached", "-out-delim", ","}, "3,A0.3\n"},
+		{"dedup", "3:101\n3:101\n1:1\n", []string{"-mode", "compress-cached", "-dedup"}, "3:A0.3\n1:80.1\n"},
+		{"comments", "# x\n3:101\n\n", []string{"-mode", "compress-noncached", "-comments"}, "3:A0.3\n"},
+		{"sort", "3:101\n1:1\n", []string{"-mode", "compress-noncached", "-sort"}, "1:80.1\n3:A0.3\n"},
+		{"null", "3:101\x001:1", []string{"-mode", "compress-noncached", "-null"}, "3:A0.3\x001:80.1\x00"},
+		{"per-size cache", "3:101\n3:101\n", []string{"-mode", "compress-cached", "-cache-per-size"}, "3:A0.3\n3:A0.3\n"},
+		{"hashed keys", "3:101\n3:101\n", []string{"-mode", "compress-cached", "-hash-keys"}, "3:A0.3\n3:A0.3\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			inputFile := writeFile(t, dir, "in", tt.in)
+			outputFile := filepath.Join(dir, "out")
+			args := append(tt.args, "-in", inputFile, "-out", outputFile)
+			if err := run(context.Background(), parseArgs(t, args...)); err != nil {
+				t.Fatal(err)
+			}
+			if got := readFile(outputFile); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Checks the fields of the JSON report
+func TestJSONReport(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		args  []string
+		check func(runReport) bool
+		fails bool
+	}{
+		{"cache", "3:101\n3:101\n", []string{"-mode", "compress-cached"}, func(r runReport) bool {
+			return r.Lines == 2 && r.Cache != nil && r.Cache.Hits == 1 && r.Mode == "compress-cached"
+		}, false},
+		{"no cache", "3:101\n3:111\n", []string{"-mode", "compress-noncached"}, func(r runReport) bool {
+			return r.Lines == 2 && r.Cache == nil && r.Error == "" && r.InputBytes == 12 && r.OutputBytes == 14 && r.Ratio > 1
+		}, false},
+		{"error", "4:1010\n4:10x0\n", []string{"-mode", "compress-noncached"}, func(r runReport) bool {
+			return r.Lines == 1 && r.Errors == 1 && strings.HasPrefix(r.Error, "line 2 (byte 7):") && r.ErrorLine == 2 && r.ErrorOffset != nil && *r.ErrorOffset == 7
+		}, true},
+		{"duplicates", "3:101\n3:101\n1:1\n", []string{"-mode", "compress-noncached", "-dedup"}, func(r runReport) bool {
+			return r.Lines == 2 && r.Duplicates == 1
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			inputFile, reportFile := filepath.Join(dir, "in"), filepath.Join(dir, "report.json")
+			os.WriteFile(inputFile, []byte(tt.in), 0o644)
+			args := append(tt.args, "-in", inputFile, "-out", filepath.Join(dir, "out"), "-report", "json", "-report-file", reportFile)
+			cfg := parseArgs(t, args...)
+			if err := run(context.Background(), cfg); (err != nil) != tt.fails {
+				t.Fatalf("run error = %v, want failure %v", err, tt.fails)
+			}
+			data, _ := os.ReadFile(reportFile)
+			var rep runReport
+			if err := json.Unmarshal(data, &rep); err != nil || !tt.check(rep) {
+				t.Errorf("unexpected report %s, %v", data, err)
+			}
+		})
+	}
+}
+
+// Checks that the JSON report of a batch run merges the stats of the worker caches
+func TestBatchCacheStats(t *testing.T) {
+	dir := t.TempDir()
+	a, b := writeFile(t, dir, "a", "3:101\n3:101\n"), writeFile(t, dir, "b", "3:101\n3:101\n3:101\n")
+	outDir, reportFile := filepath.Join(dir, "out"), filepath.Join(dir, "report.json")
+	os.Mkdir(outDir, 0o755)
+	cfg := parseArgs(t, "-mode", "compress-cached", "-in", a, "-out", outDir, "-workers", "2", "-report", "json", "-report-file", reportFile, b)
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(reportFile)
+	var rep runReport
+	if err := json.Unmarshal(data, &rep); err != nil || rep.Cache == nil || rep.Cache.Hits+rep.Cache.Misses != 5 || rep.Cache.Hits < 3 {
+		t.Errorf("unexpected report %s, %v", data, err)
+	}
+}
+
+// Checks that -recursive converts the matching files of every subdirectory
+func TestRecursive(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "top.in", "3:101\n")
+	writeFile(t, dir, "a/b/deep.in", "3:111\n")
+	writeFile(t, dir, "a/skip.txt", "3:111\n")
+	writeFile(t, dir, "a/bad.in", "nocolon\n")
+	if err := run(context.Background(), parseArgs(t, "-mode", "compress-noncached", "-in", dir, "-recursive", "-workers", "2")); err == nil {
+		t.Error("bad.in did not fail the run")
+	}
+	if got := readFile(filepath.Join(dir, "a/b/deep.in.x")); got != "3:E0.3\n" {
+		t.Errorf("deep.in.x = %q", got)
+	}
+	if got := readFile(filepath.Join(dir, "top.in.x")); got != "3:A0.3\n" {
+		t.Errorf("top.in.x = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a/skip.txt.x")); err == nil {
+		t.Error("converted a file not matching -glob")
+	}
+}
+
+// Checks that an existing output is only replaced with -force
+func TestForce(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := writeFile(t, dir, "in", "3:101\n")
+	outputFile := writeFile(t, dir, "out", "keep")
+	args := []string{"-mode", "compress-noncached", "-in", inputFile, "-out", outputFile}
+	if err := run(context.Background(), parseArgs(t, args...)); err == nil || readFile(outputFile) != "keep" {
+		t.Fatalf("existing output replaced without -force: %v", err)
+	}
+	if err := run(context.Background(), parseArgs(t, append(args, "-force")...)); err != nil || readFile(outputFile) != "3:A0.3\n" {
+		t.Errorf("-force gave %q, %v", readFile(outputFile), err)
+	}
+}
+
+// Checks the final line printed by the -progress meter
+func TestProgressMeter(t *testing.T) {
+	var out strings.Builder
+	p := newProgressMeter(&out)
+	p.add(5)
+	p.add(7)
+	p.finish()
+	if got := out.String(); !strings.HasPrefix(got, "\r12 lines, ") || !strings.HasSuffix(got, " lines/s\n") {
+		t.Errorf("progress output = %q", got)
+	}
+}
+
+// Checks that -version prints the version and Go release and exits without a mode
+func TestVersionString(t *testing.T) {
+	want := version + " " + runtime.Version()
+	if got := versionString(); !strings.HasPrefix(got, want) {
+		t.Errorf("versionString() = %q, want it to start with %q", got, want)
+	}
+	if out, code := runMain(t, "-version"); code != 0 || !strings.HasPrefix(out, want) {
+		t.Errorf("-version: exit %d with %q", code, out)
+	}
+}
+
+// Checks -max-errors and the skipped lines written to -errors
+func TestSkipErrors(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := writeFile(t, dir, "in", "4:1010\n4:10x0\n8:11110000\nbad\n")
+	errorsFile := filepath.Join(dir, "errors")
+	args := []string{"-mode", "compress-noncached", "-in", inputFile, "-out", filepath.Join(dir, "out"), "-force", "-skip-errors", "-line-workers", "2"}
+	if err := run(context.Background(), parseArgs(t, append(args, "-max-errors", "2", "-errors", errorsFile)...)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(filepath.Join(dir, "out")); got != "4:A0.4\n8:F0\n" {
+		t.Errorf("output %q", got)
+	}
+	want := "line 2 (byte 7): invalid binary character 'x' at index 2\t\"4:10x0\"\n" +
+		"line 4 (byte 25): malformed line \"bad\": missing \":\" separator\t\"bad\"\n"
+	if got := readFile(errorsFile); got != want {
+		t.Errorf("errors file %q, want %q", got, want)
+	}
+	if err := run(context.Background(), parseArgs(t, append(args, "-max-errors", "1")...)); err == nil {
+		t.Error("two skipped lines passed -max-errors 1")
+	}
+}
+
+// Checks that -dry-run converts without creating the output
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := writeFile(t, dir, "in", "3:101\n")
+	outputFile := filepath.Join(dir, "out")
+	if err := run(context.Background(), parseArgs(t, "-mode", "compress-noncached", "-in", inputFile, "-out", outputFile, "-dry-run")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(outputFile); err == nil {
+		t.Error("dry run created the output")
+	}
+	if err := run(context.Background(), parseArgs(t, "-mode", "compress-noncached", "-in", writeFile(t, dir, "bad", "3:1x1\n"), "-dry-run")); err == nil {
+		t.Error("dry run accepted a bad line")
+	}
+}
+
+// Checks that -bench repeats the run and reports the throughput over every run
+func TestBench(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := writeFile(t, dir, "in", "3:101\n3:111\n")
+	outputFile := filepath.Join(dir, "out")
+	out, code := runMain(t, "-mode", "compress-cached", "-in", inputFile, "-out", outputFile, "-bench", "3")
+	if code != 0 || !strings.Contains(out, "msg=throughput runs=3 ") || !strings.Contains(out, "misses=2 ") {
+		t.Errorf("exit %d with %q", code, out)
+	}
+	if got := readFile(outputFile); got != "3:A0.3\n3:E0.3\n" {
+		t.Errorf("output %q", got)
+	}
+}
+
+// Checks that the stats logger sums the caches it watches and forgets them on reset
+func TestStatsLogger(t *testing.T) {
+	logs := captureLogs(t, slog.LevelInfo)
+	l := startStatsLogger(time.Hour)
+	defer l.stop()
+	for _, key := range []string{"a", "c"} {
+		cache := matconv.NewCache[string](4)
+		cache.Set(key, "b")
+		cache.Get(key)
+		cache.Get("z")
+		l.watch(cache)
+	}
+	l.print()
+	if !strings.Contains(logs.String(), "hits=2 misses=2 hit_ratio=0.5 size=2") {
+		t.Errorf("logs %q", logs.String())
+	}
+	l.reset()
+	cache := matconv.NewCache[string](4)
+	cache.Set("a", "b")
+	cache.Get("a")
+	l.watch(cache)
+	l.print()
+	if !strings.Contains(logs.String(), "hits=1 misses=0 hit_ratio=1 size=1") {
+		t.Errorf("logs after reset %q", logs.String())
+	}
+}
+
+// Checks that logs carry the run details and respect -log-level
+func TestLogging(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := writeFile(t, dir, "in", "3:101\n")
+	logs := captureLogs(t, slog.LevelInfo)
+	if err := run(context.Background(), parseArgs(t, "-mode", "compress-cached", "-in", inputFile, "-out", filepath.Join(dir, "out"))); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "level=INFO") || !strings.Contains(logs.String(), "lines=1") {
+		t.Errorf("logs %q", logs.String())
+	}
+	quiet := captureLogs(t, slog.LevelError)
+	if err := run(context.Background(), parseArgs(t, "-mode", "compress-cached", "-in", filepath.Join(dir, "missing"), "-out", filepath.Join(dir, "out2"))); err == nil {
+		t.Fatal("missing input converted")
+	}
+	if strings.Contains(quiet.String(), "INFO") {
+		t.Errorf("-log-level error logged %q", quiet.String())
+	}
+}
+
+// Checks that -warm preloads the cache
+func TestWarm(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := writeFile(t, dir, "in", "3:101\n3:111\n")
+	warmFile := writeFile(t, dir, "warm", "3:101\n")
+	reportFile := filepath.Join(dir, "report.json")
+	cfg := parseArgs(t, "-mode", "compress-cached", "-in", inputFile, "-out", filepath.Join(dir, "out"), "-warm", warmFile, "-report", "json", "-report-file", reportFile)
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	var rep runReport
+	if err := json.Unmarshal([]byte(readFile(reportFile)), &rep); err != nil || rep.Cache.Hits != 1 || rep.Cache.Misses != 1 {
+		t.Errorf("report %s, %v, want one hit and one miss", readFile(reportFile), err)
+	}
+}
+
+// Checks that -count-only logs the input statistics without needing -mode or -out
+func TestCountOnly(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := writeFile(t, dir, "in", "3:101\n3:1\nnope\n")
+	out, code := runMain(t, "-count-only", "-in", inputFile)
+	if code != 0 || !strings.Contains(out, "lines=3 malformed=1 distinct_sizes=1 min_bits=1 avg_bits=2 max_bits=3") {
+		t.Errorf("exit %d with %q", code, out)
+	}
+}
+
+// Checks the outputs written with -fsync, -atomic and -split-lines
+func TestOutputFlags(t *testing.T) {
+	dir := t.TempDir()
+	var in strings.Builder
+	for i := 0; i < 25; i++ {
+		fmt.Fprintf(&in, "8:%08b\n", i)
+	}
+	inputFile := writeFile(t, dir, "in", in.String())
+	tests := []struct {
+		name   string
+		args   []string
+		chunks []int
+	}{
+		{"fsync atomic", []string{"-fsync", "-atomic"}, nil},
+		{"fsync in place", []string{"-fsync"}, nil},
+		{"split lines", []string{"-split-lines", "10"}, []int{10, 10, 5}},
+		{"fsync split lines", []string{"-fsync", "-split-lines", "10"}, []int{10, 10, 5}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputFile := filepath.Join(dir, fmt.Sprintf("out%d", i))
+			args := append([]string{"-mode", "compress-noncached", "-in", inputFile, "-out", outputFile}, tt.args...)
+			if err := run(context.Background(), parseArgs(t, args...)); err != nil {
+				t.Fatal(err)
+			}
+			if tt.chunks == nil {
+				if got := strings.Count(readFile(outputFile), "\n"); got != 25 {
+					t.Errorf("wrote %d lines, want 25", got)
+				}
+				return
+			}
+			for j, want := range tt.chunks {
+				if got := strings.Count(readFile(fmt.Sprintf("%s.%03d", outputFile, j)), "\n"); got != want {
+					t.Errorf("chunk %d holds %d lines, want %d", j, got, want)
+				}
+			}
+			if _, err := os.Stat(fmt.Sprintf("%s.%03d", outputFile, len(tt.chunks))); err == nil {
+				t.Error("extra chunk written")
+			}
+		})
+	}
+}
+
+// Checks the rows printed by -histogram
+func TestWriteHistogram(t *testing.T) {
+	var b strings.Builder
+	if err := writeHistogram(&b, []matconv.Bucket{{Low: 0, High: 1, Lines: 3}, {Low: 2, High: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != "0-1\t3\n2-3\t0\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+// Checks that -limit stops each input after that many lines
+func TestLimit(t *testing.T) {
+	dir := t.TempDir()
+	var in strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&in, "8:%08b\n", i)
+	}
+	inputFile := writeFile(t, dir, "in", in.String())
+	for _, workers := range []string{"1", "3"} {
+		outputFile := filepath.Join(dir, "out"+workers)
+		cfg := parseArgs(t, "-mode", "compress-cached", "-in", inputFile, "-out", outputFile, "-limit", "10", "-line-workers", workers, "-atomic")
+		if err := run(context.Background(), cfg); err != nil {
+			t.Fatal(err)
+		}
+		got := readFile(outputFile)
+		if strings.Count(got, "\n") != 10 || !strings.HasPrefix(got, "8:00\n") || !strings.HasSuffix(got, "8:09\n") {
+			t.Errorf("line workers %s: got %q", workers, got)
+		}
+	}
+}
+
+// Checks that a canceled batch stops with whole lines in its outputs
+func TestCancelRun(t *testing.T) {
+	dir := t.TempDir()
+	in := strings.Repeat("16:1010101010101010\n", 200000)
+	a, c := writeFile(t, dir, "a", in), writeFile(t, dir, "c", in)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := run(ctx, parseArgs(t, "-mode", "compress-noncached", "-in", a, "-out", filepath.Join(dir, "b"))); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled run gave %v", err)
+	}
+	outDir := filepath.Join(dir, "out")
+	os.Mkdir(outDir, 0o755)
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(5*time.Millisecond, cancel)
+	err := run(ctx, parseArgs(t, "-mode", "compress-noncached", "-in", a, "-out", outDir, "-workers", "1", "-line-workers", "2", c))
+	if !errors.Is(err, context.Canceled) {
+		t.Skipf("run finished before the cancel: %v", err)
+	}
+	if got := readFile(filepath.Join(outDir, "a.x")); got != strings.Repeat("16:AAAA\n", strings.Count(got, "\n")) {
+		t.Errorf("canceled output holds a partial line")
+	}
+}
+
+// Checks that -follow stops cleanly on an interrupt
+func TestFollow(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := writeFile(t, dir, "in", "3:101\n")
+	outputFile := filepath.Join(dir, "out")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(600*time.Millisecond, cancel)
+	if err := run(ctx, parseArgs(t, "-mode", "compress-noncached", "-follow", "-in", inputFile, "-out", outputFile)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(outputFile); got != "3:A0.3\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+// Checks the selftest mode, which needs no input
+func TestSelfTestMode(t *testing.T) {
+	if err := run(context.Background(), parseArgs(t, "-mode", "selftest")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/Com4n/task5
+
+go 1.22
@@ -0,0 +1,857 @@
+package matconv
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/gob"
+	"hash/fnv"
+	"hash/maphash"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache maps string keys to values of type V and is safe for concurrent use.
+// A maxEntries of zero or less means the cache is unbounded and never evicts.
+// A positive maxBytes, set by NewCacheBytes, additionally bounds the total length
+// of keys and values.
+type Cache[V any] struct {
+	mu         sync.RWMutex
+	maxEntries int
+	maxBytes   int
+	bytes      int
+	ttl        time.Duration
+	entries    map[string]cacheEntry[V]
+	policy     EvictionPolicy
+	hits       int
+	misses     int
+	sizeOf     func(V) int
+	hash       func(string) uint64
+	seed       maphash.Seed
+	collisions int
+	pending    map[string]*pendingCall[V]
+
+	// OnEvict, if set, is called with each entry removed to make room for
+	// new ones. It runs after the entry is gone and outside the cache lock.
+	OnEvict func(key string, value V)
+	// NotifyOnDelete makes Delete invoke OnEvict as well
+	NotifyOnDelete bool
+}
+
+// cacheEntry is a cached value along with the time it was stored and the number of
+// hits since. check is a second hash of the original key, used to tell hashed keys apart.
+type cacheEntry[V any] struct {
+	value      V
+	insertedAt time.Time
+	accesses   int
+	check      uint64
+}
+
+// CacheStats holds hit/miss counters for a cache
+type CacheStats struct {
+	Hits     int     `json:"hits"`
+	Misses   int     `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// NewCache creates a new LRU cache with a given maximum number of entries
+func NewCache[V any](maxEntries int) *Cache[V] {
+	return NewCacheWithTTL[V](maxEntries, 0)
+}
+
+// NewCacheWithTTL creates a new LRU cache whose entries expire after ttl; a zero ttl never expires
+func NewCacheWithTTL[V any](maxEntries int, ttl time.Duration) *Cache[V] {
+	return newCache[V](maxEntries, ttl, NewLRUPolicy())
+}
+
+// NewCacheWithPolicy creates a new cache that evicts according to policy
+func NewCacheWithPolicy[V any](maxEntries int, policy EvictionPolicy) *Cache[V] {
+	return newCache[V](maxEntries, 0, policy)
+}
+
+// NewCacheBytes creates a new LRU cache bounded by the total length of its keys and values
+func NewCacheBytes[V ~string | ~[]byte](maxBytes int) *Cache[V] {
+	cache := NewCache[V](0)
+	cache.maxBytes = maxBytes
+	cache.sizeOf = func(value V) int { return len(value) }
+	return cache
+}
+
+// NewHashedCache creates a new LRU cache that stores a 64-bit hash of each key
+// instead of the key itself, which saves memory when keys are long. A nil hash
+// uses FNV-1a. Keys that collide with a stored one are kept in full. Keys, TopKeys,
+// the eviction order accessors, SaveToFile and OnEvict see the stored form of the
+// keys rather than the original strings.
+func NewHashedCache[V any](maxEntries int, hash func(string) uint64) *Cache[V] {
+	if hash == nil {
+		hash = fnvHash
+	}
+	cache := NewCache[V](maxEntries)
+	cache.hash = hash
+	cache.seed = maphash.MakeSeed()
+	return cache
+}
+
+// fnvHash returns the 64-bit FNV-1a hash of key
+func fnvHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// Prefixes of the stored keys of a hashed cache, keeping hashes and full keys apart
+const (
+	hashedKeyPrefix = "h"
+	fullKeyPrefix   = "f"
+)
+
+// storageKey returns the entries key that key is, or would be, stored under along
+// with its check hash. Without key hashing that is key itself.
+func (c *Cache[V]) storageKey(key string) (string, uint64) {
+	if c.hash == nil {
+		return key, 0
+	}
+	check := maphash.String(c.seed, key)
+	full := fullKeyPrefix + key
+	if c.collisions > 0 {
+		if _, exists := c.entries[full]; exists {
+			return full, check
+		}
+	}
+	hashed := string(binary.BigEndian.AppendUint64([]byte(hashedKeyPrefix), c.hash(key)))
+	if entry, exists := c.entries[hashed]; exists && entry.check != check {
+		return full, check
+	}
+	return hashed, check
+}
+
+func newCache[V any](maxEntries int, ttl time.Duration, policy EvictionPolicy) *Cache[V] {
+	return &Cache[V]{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    make(map[string]cacheEntry[V]),
+		policy:     policy,
+	}
+}
+
+// Get retrieves a value from the cache and reports the access to the eviction policy.
+// The policy may reorder keys, so Get takes the write lock.
+func (c *Cache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(key)
+}
+
+// GetWithRank is Get, also returning how deep in the eviction order the hit was before
+// this access: rank 0 is the entry that would be evicted last, which under LRU is the
+// most recently used one. A hit at a rank close to Len suggests the cache is too small.
+// Finding the rank scans the eviction order.
+func (c *Cache[V]) GetWithRank(key string) (value V, rank int, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stored, _ := c.storageKey(key)
+	keys := c.policy.Keys()
+	index := slices.Index(keys, stored)
+	value, ok = c.get(key)
+	if !ok {
+		return value, 0, false
+	}
+	return value, len(keys) - 1 - index, true
+}
+
+// get is Get for callers holding the write lock
+func (c *Cache[V]) get(key string) (V, bool) {
+	key, _ = c.storageKey(key)
+	entry, exists := c.entries[key]
+	if exists && c.expired(entry) {
+		c.deleteEntry(key)
+		c.policy.Remove(key)
+		exists = false
+	}
+	if !exists {
+		c.misses++
+		var zero V
+		return zero, false
+	}
+	c.hits++
+	entry.accesses++
+	c.entries[key] = entry
+	c.policy.Touch(key)
+	return entry.value, true
+}
+
+// pendingCall is a GetOrSet computation in progress, waited on by other callers for the same key
+type pendingCall[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// GetOrSet returns the value cached for key or, on a miss, calls compute and caches its
+// result. Concurrent callers for a missing key wait for a single compute call and share
+// its result; other keys are not blocked meanwhile. A failed compute is not cached.
+func (c *Cache[V]) GetOrSet(key string, compute func() (V, error)) (V, error) {
+	c.mu.Lock()
+	if value, ok := c.get(key); ok {
+		c.mu.Unlock()
+		return value, nil
+	}
+	if call, ok := c.pending[key]; ok {
+		// The value is being computed already, so this is counted as a hit
+		c.misses--
+		c.hits++
+		c.mu.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	if c.pending == nil {
+		c.pending = make(map[string]*pendingCall[V])
+	}
+	call := &pendingCall[V]{done: make(chan struct{})}
+	c.pending[key] = call
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	call.value, call.err = compute()
+	if call.err == nil {
+		c.Set(key, call.value)
+	}
+	return call.value, call.err
+}
+
+// expired reports whether entry has outlived the cache TTL
+func (c *Cache[V]) expired(entry cacheEntry[V]) bool {
+	return c.ttl > 0 && time.Since(entry.insertedAt) > c.ttl
+}
+
+// Contains reports whether key is cached without affecting recency or statistics
+func (c *Cache[V]) Contains(key string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	key, _ = c.storageKey(key)
+	entry, exists := c.entries[key]
+	return exists && !c.expired(entry)
+}
+
+// Peek returns the value cached for key like Get, but without promoting it in the
+// eviction order or counting a hit or miss
+func (c *Cache[V]) Peek(key string) (V, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	key, _ = c.storageKey(key)
+	entry, exists := c.entries[key]
+	if !exists || c.expired(entry) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// EntryInfo returns when the value for key was stored and how many times Get has
+// returned it since, without promoting it in the eviction order
+func (c *Cache[V]) EntryInfo(key string) (insertedAt time.Time, accesses int, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	key, _ = c.storageKey(key)
+	entry, exists := c.entries[key]
+	if !exists || c.expired(entry) {
+		return time.Time{}, 0, false
+	}
+	return entry.insertedAt, entry.accesses, true
+}
+
+// KeyCount is a cached key with the number of times Get has returned its value
+type KeyCount struct {
+	Key   string
+	Count int
+}
+
+// TopKeys returns the k cached keys that Get has returned most often since they were
+// stored, most accessed first and equal counts in key order. It does not change any state.
+func (c *Cache[V]) TopKeys(k int) []KeyCount {
+	if k <= 0 {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	counts := make([]KeyCount, 0, len(c.entries))
+	for key, entry := range c.entries {
+		if !c.expired(entry) {
+			counts = append(counts, KeyCount{key, entry.accesses})
+		}
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Key < counts[j].Key
+	})
+	return counts[:min(k, len(counts))]
+}
+
+// Stats returns the hit/miss counters and the resulting hit ratio
+func (c *Cache[V]) Stats() CacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	stats := CacheStats{Hits: c.hits, Misses: c.misses}
+	if total := c.hits + c.misses; total > 0 {
+		stats.HitRatio = float64(c.hits) / float64(total)
+	}
+	return stats
+}
+
+// MergeStats sums the hit/miss counters of several caches, such as the per-worker
+// caches of ConvertFiles, and computes the combined hit ratio
+func MergeStats[V any](caches ...*Cache[V]) CacheStats {
+	var total CacheStats
+	for _, cache := range caches {
+		stats := cache.Stats()
+		total.Hits += stats.Hits
+		total.Misses += stats.Misses
+	}
+	if all := total.Hits + total.Misses; all > 0 {
+		total.HitRatio = float64(total.Hits) / float64(all)
+	}
+	return total
+}
+
+// Set adds or updates a key-value pair in the cache, evicting the entry chosen by
+// the policy when a new key is inserted into a full cache. An entry larger than the
+// maxBytes of NewCacheBytes is not stored, and only drops the stale value of its key.
+func (c *Cache[V]) Set(key string, value V) {
+	c.mu.Lock()
+	var evicted []evictedEntry[V]
+	key, check := c.storageKey(key)
+	if c.maxBytes > 0 && len(key)+c.size(value) > c.maxBytes {
+		if _, exists := c.entries[key]; exists {
+			c.deleteEntry(key)
+			c.policy.Remove(key)
+		}
+		c.mu.Unlock()
+		return
+	}
+	if old, exists := c.entries[key]; exists {
+		c.bytes -= c.size(old.value)
+		c.policy.Touch(key)
+	} else {
+		if c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+			evicted = append(evicted, c.evictOldest())
+		}
+		c.bytes += len(key)
+		c.policy.Add(key)
+		if c.hash != nil && strings.HasPrefix(key, fullKeyPrefix) {
+			c.collisions++
+		}
+	}
+	c.entries[key] = cacheEntry[V]{value: value, insertedAt: time.Now(), check: check}
+	c.bytes += c.size(value)
+	for c.maxBytes > 0 && c.bytes > c.maxBytes {
+		evicted = append(evicted, c.evictOldest())
+	}
+	onEvict := c.OnEvict
+	c.mu.Unlock()
+	notifyEvicted(onEvict, evicted)
+}
+
+// evictedEntry is an entry removed from the cache, pending the OnEvict callback
+type evictedEntry[V any] struct {
+	key   string
+	value V
+}
+
+// size returns the byte length counted for value, which is only tracked by NewCacheBytes
+func (c *Cache[V]) size(value V) int {
+	if c.sizeOf == nil {
+		return 0
+	}
+	return c.sizeOf(value)
+}
+
+// evictOldest removes the entry chosen by the policy and returns it
+func (c *Cache[V]) evictOldest() evictedEntry[V] {
+	oldestKey := c.policy.Evict()
+	entry := c.deleteEntry(oldestKey)
+	return evictedEntry[V]{key: oldestKey, value: entry.value}
+}
+
+// deleteEntry removes key from the entries map and the byte accounting
+func (c *Cache[V]) deleteEntry(key string) cacheEntry[V] {
+	entry := c.entries[key]
+	delete(c.entries, key)
+	c.bytes -= len(key) + c.size(entry.value)
+	if c.hash != nil && strings.HasPrefix(key, fullKeyPrefix) {
+		c.collisions--
+	}
+	return entry
+}
+
+// notifyEvicted invokes onEvict for each evicted entry; callers must not hold the lock
+func notifyEvicted[V any](onEvict func(key string, value V), evicted []evictedEntry[V]) {
+	if onEvict == nil {
+		return
+	}
+	for _, e := range evicted {
+		onEvict(e.key, e.value)
+	}
+}
+
+// Resize changes the maximum number of entries, evicting entries chosen by the
+// policy if the cache holds more than n; n <= 0 removes the limit
+func (c *Cache[V]) Resize(n int) {
+	c.mu.Lock()
+	var evicted []evictedEntry[V]
+	c.maxEntries = n
+	for n > 0 && len(c.entries) > n {
+		evicted = append(evicted, c.evictOldest())
+	}
+	onEvict := c.OnEvict
+	c.mu.Unlock()
+	notifyEvicted(onEvict, evicted)
+}
+
+// Delete removes key from the cache and reports whether it was present.
+// OnEvict is only invoked for deleted entries when NotifyOnDelete is set.
+func (c *Cache[V]) Delete(key string) bool {
+	c.mu.Lock()
+	key, _ = c.storageKey(key)
+	entry, exists := c.entries[key]
+	if !exists {
+		c.mu.Unlock()
+		return false
+	}
+	c.deleteEntry(key)
+	c.policy.Remove(key)
+	onEvict := c.OnEvict
+	notify := c.NotifyOnDelete
+	c.mu.Unlock()
+	if notify {
+		notifyEvicted(onEvict, []evictedEntry[V]{{key: key, value: entry.value}})
+	}
+	return true
+}
+
+// Clear removes all entries while keeping the allocated capacity
+func (c *Cache[V]) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		delete(c.entries, key)
+	}
+	c.bytes = 0
+	c.collisions = 0
+	c.policy.Reset()
+}
+
+// Len returns the number of entries currently stored
+func (c *Cache[V]) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
+
+// Cap returns the maximum number of entries, or 0 when the entry count is unbounded
+func (c *Cache[V]) Cap() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return max(c.maxEntries, 0)
+}
+
+// Fullness returns Len()/Cap(), or 0 when the entry count is unbounded
+func (c *Cache[V]) Fullness() float64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.maxEntries <= 0 {
+		return 0
+	}
+	return float64(len(c.entries)) / float64(c.maxEntries)
+}
+
+// Keys returns a copy of the cached keys in eviction order, next to be evicted first
+func (c *Cache[V]) Keys() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.policy.Keys()
+}
+
+// LeastRecent returns the entry the policy will evict next, without changing any state
+func (c *Cache[V]) LeastRecent() (key string, value V, ok bool) {
+	return c.endpoint(true)
+}
+
+// MostRecent returns the entry the policy will evict last; for LRU that is the most
+// recently used one. It does not change any state.
+func (c *Cache[V]) MostRecent() (key string, value V, ok bool) {
+	return c.endpoint(false)
+}
+
+// endpoint returns the first or last entry in eviction order
+func (c *Cache[V]) endpoint(first bool) (key string, value V, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := c.policy.Keys()
+	if len(keys) == 0 {
+		return "", value, false
+	}
+	key = keys[len(keys)-1]
+	if first {
+		key = keys[0]
+	}
+	return key, c.entries[key].value, true
+}
+
+// cacheRecord is the on-disk form of a cache entry
+type cacheRecord[V any] struct {
+	Key   string
+	Value V
+}
+
+// SaveToFile writes the cache entries to path in eviction order
+func (c *Cache[V]) SaveToFile(path string) error {
+	c.mu.RLock()
+	keys := c.policy.Keys()
+	records := make([]cacheRecord[V], 0, len(keys))
+	for _, key := range keys {
+		records = append(records, cacheRecord[V]{Key: key, Value: c.entries[key].value})
+	}
+	c.mu.RUnlock()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(file).Encode(records); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// LoadCacheFromFile reads a cache written by SaveToFile, restoring its eviction order
+func LoadCacheFromFile[V any](path string, maxEntries int) (*Cache[V], error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []cacheRecord[V]
+	if err := gob.NewDecoder(file).Decode(&records); err != nil {
+		return nil, err
+	}
+	cache := NewCache[V](maxEntries)
+	for _, r := range records {
+		cache.Set(r.Key, r.Value)
+	}
+	return cache, nil
+}
+
+// EvictionPolicy decides which key a Cache evicts when it is full.
+// Implementations are not safe for concurrent use; Cache serializes calls to them.
+type EvictionPolicy interface {
+	// Add records a newly inserted key
+	Add(key string)
+	// Touch records an access to an existing key
+	Touch(key string)
+	// Remove forgets a key that was deleted from the cache
+	Remove(key string)
+	// Evict removes and returns the next key to evict
+	Evict() string
+	// Keys returns a copy of the tracked keys in eviction order
+	Keys() []string
+	// Reset forgets all keys
+	Reset()
+}
+
+// fifoPolicy evicts keys in insertion order. The keys are kept in a list, with a map
+// to their elements so that Remove, and lruPolicy's Touch, do not scan it.
+type fifoPolicy struct {
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+// NewFIFOPolicy returns a policy that evicts the oldest inserted key
+func NewFIFOPolicy() EvictionPolicy {
+	policy := newFIFOPolicy()
+	return &policy
+}
+
+// newFIFOPolicy returns an empty fifoPolicy, which the other policies build on
+func newFIFOPolicy() fifoPolicy {
+	return fifoPolicy{order: list.New(), elements: make(map[string]*list.Element)}
+}
+
+func (p *fifoPolicy) Add(key string) {
+	p.elements[key] = p.order.PushBack(key)
+}
+
+func (p *fifoPolicy) Touch(key string) {}
+
+func (p *fifoPolicy) Remove(key string) {
+	if e, ok := p.elements[key]; ok {
+		p.order.Remove(e)
+		delete(p.elements, key)
+	}
+}
+
+func (p *fifoPolicy) Evict() string {
+	e := p.order.Front()
+	if e == nil {
+		return ""
+	}
+	key := p.order.Remove(e).(string)
+	delete(p.elements, key)
+	return key
+}
+
+func (p *fifoPolicy) Keys() []string {
+	keys := make([]string, 0, p.order.Len())
+	for e := p.order.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(string))
+	}
+	return keys
+}
+
+func (p *fifoPolicy) Reset() {
+	p.order.Init()
+	clear(p.elements)
+}
+
+// lruPolicy evicts the least recently used key
+type lruPolicy struct {
+	fifoPolicy
+}
+
+// NewLRUPolicy returns a policy that evicts the least recently used key
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{newFIFOPolicy()}
+}
+
+// Touch moves key to the most recently used end of the list
+func (p *lruPolicy) Touch(key string) {
+	if e, ok := p.elements[key]; ok {
+		p.order.MoveToBack(e)
+	}
+}
+
+// lfuPolicy evicts the least frequently used key, breaking ties by insertion order
+type lfuPolicy struct {
+	fifoPolicy
+	counts map[string]int
+}
+
+// NewLFUPolicy returns a policy that evicts the least frequently used key
+func NewLFUPolicy() EvictionPolicy {
+	return &lfuPolicy{fifoPolicy: newFIFOPolicy(), counts: make(map[string]int)}
+}
+
+func (p *lfuPolicy) Add(key string) {
+	p.fifoPolicy.Add(key)
+	p.counts[key] = 0
+}
+
+func (p *lfuPolicy) Touch(key string) {
+	p.counts[key]++
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	p.fifoPolicy.Remove(key)
+	delete(p.counts, key)
+}
+
+func (p *lfuPolicy) Evict() string {
+	victim := p.order.Front()
+	if victim == nil {
+		return ""
+	}
+	for e := victim.Next(); e != nil; e = e.Next() {
+		if p.counts[e.Value.(string)] < p.counts[victim.Value.(string)] {
+			victim = e
+		}
+	}
+	key := victim.Value.(string)
+	p.Remove(key)
+	return key
+}
+
+func (p *lfuPolicy) Keys() []string {
+	keys := p.fifoPolicy.Keys()
+	sort.SliceStable(keys, func(i, j int) bool {
+		return p.counts[keys[i]] < p.counts[keys[j]]
+	})
+	return keys
+}
+
+func (p *lfuPolicy) Reset() {
+	p.fifoPolicy.Reset()
+	for key := range p.counts {
+		delete(p.counts, key)
+	}
+}
+
+// partitionedPolicy keeps a separate policy per partition of the keys and evicts from
+// the partition holding the most keys
+type partitionedPolicy struct {
+	partition func(key string) string
+	newPolicy func() EvictionPolicy
+	parts     map[string]EvictionPolicy
+	counts    map[string]int
+}
+
+// NewPartitionedPolicy returns a policy that groups keys by partition, ordering each group
+// with its own policy from newPolicy, and evicts from the largest group (the first by
+// name on a tie). A burst of keys in one partition so only evicts keys of its own once it
+// is the largest, leaving the others their share of the cache.
+func NewPartitionedPolicy(partition func(key string) string, newPolicy func() EvictionPolicy) EvictionPolicy {
+	return &partitionedPolicy{
+		partition: partition,
+		newPolicy: newPolicy,
+		parts:     make(map[string]EvictionPolicy),
+		counts:    make(map[string]int),
+	}
+}
+
+// PartitionBySize returns a partition function that groups matrixSize:value lines by
+// their matrix size, for NewPartitionedPolicy
+func PartitionBySize(opts Options) func(key string) string {
+	delim := opts.delimiter()
+	return func(key string) string {
+		size, _, _ := strings.Cut(key, delim)
+		return size
+	}
+}
+
+func (p *partitionedPolicy) Add(key string) {
+	part := p.partition(key)
+	policy, ok := p.parts[part]
+	if !ok {
+		policy = p.newPolicy()
+		p.parts[part] = policy
+	}
+	policy.Add(key)
+	p.counts[part]++
+}
+
+func (p *partitionedPolicy) Touch(key string) {
+	if policy, ok := p.parts[p.partition(key)]; ok {
+		policy.Touch(key)
+	}
+}
+
+func (p *partitionedPolicy) Remove(key string) {
+	part := p.partition(key)
+	if policy, ok := p.parts[part]; ok {
+		policy.Remove(key)
+		p.forget(part)
+	}
+}
+
+func (p *partitionedPolicy) Evict() string {
+	part := largestPartition(p.counts)
+	key := p.parts[part].Evict()
+	p.forget(part)
+	return key
+}
+
+// Keys replays the evictions over copies of the partitions' key orders
+func (p *partitionedPolicy) Keys() []string {
+	orders := make(map[string][]string, len(p.parts))
+	counts := make(map[string]int, len(p.counts))
+	total := 0
+	for part, policy := range p.parts {
+		orders[part] = policy.Keys()
+		counts[part] = p.counts[part]
+		total += p.counts[part]
+	}
+	keys := make([]string, 0, total)
+	for len(keys) < total {
+		part := largestPartition(counts)
+		keys = append(keys, orders[part][0])
+		orders[part] = orders[part][1:]
+		if counts[part]--; counts[part] == 0 {
+			delete(counts, part)
+		}
+	}
+	return keys
+}
+
+func (p *partitionedPolicy) Reset() {
+	clear(p.parts)
+	clear(p.counts)
+}
+
+// forget decrements the key count of part, dropping the partition once it is empty
+func (p *partitionedPolicy) forget(part string) {
+	if p.counts[part]--; p.counts[part] == 0 {
+		delete(p.counts, part)
+		delete(p.parts, part)
+	}
+}
+
+// largestPartition returns the partition with the highest count, the first by name on a tie
+func largestPartition(counts map[string]int) string {
+	largest, most := "", -1
+	for part, n := range counts {
+		if n > most || (n == most && part < largest) {
+			largest, most = part, n
+		}
+	}
+	return largest
+}
+
+// ShardedCache spreads keys across several independently locked caches
+// to reduce lock contention between goroutines
+type ShardedCache[V any] struct {
+	shards []*Cache[V]
+}
+
+// NewShardedCache creates a cache of n shards that together hold at most maxEntries.
+// The shard count is capped at maxEntries so that every shard stays bounded.
+func NewShardedCache[V any](maxEntries, n int) *ShardedCache[V] {
+	if maxEntries > 0 && n > maxEntries {
+		n = maxEntries
+	}
+	n = max(n, 1)
+	shards := make([]*Cache[V], n)
+	for i := range shards {
+		size := maxEntries / n
+		if i < maxEntries%n {
+			size++
+		}
+		shards[i] = NewCache[V](size)
+	}
+	return &ShardedCache[V]{shards: shards}
+}
+
+// shard returns the cache responsible for key
+func (s *ShardedCache[V]) shard(key string) *Cache[V] {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// Get retrieves a value from the shard holding key
+func (s *ShardedCache[V]) Get(key string) (V, bool) {
+	return s.shard(key).Get(key)
+}
+
+// Set adds or updates a key-value pair in the shard holding key
+func (s *ShardedCache[V]) Set(key string, value V) {
+	s.shard(key).Set(key, value)
+}
+
+// Len returns the total number of entries across all shards
+func (s *ShardedCache[V]) Len() int {
+	total := 0
+	for _, shard := range s.shards {
+		total += shard.Len()
+	}
+	return total
+}
@@ -0,0 +1,644 @@
+package matconv
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setAll stores each key of keys with itself as the value
+func setAll(c *Cache[string], keys ...string) {
+	for _, key := range keys {
+		c.Set(key, key)
+	}
+}
+
+// Checks that the cache evicts the least recently used key
+func TestLRU(t *testing.T) {
+	c := NewCache[string](2)
+	c.Set("a", "1")
+	c.Set("b", "2")
+	c.Get("a")
+	c.Set("c", "3")
+	if _, ok := c.Get("b"); ok {
+		t.Error("b was not evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v != "1" {
+		t.Errorf("Get(a) = %q, %v, want 1, true", v, ok)
+	}
+}
+
+// Hammers one cache from 100 goroutines; run with -race
+func TestConcurrent(t *testing.T) {
+	c := NewCache[string](10)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := string(rune('a' + (i+j)%26))
+				c.Set(key, key)
+				if v, ok := c.Get(key); ok && v != key {
+					t.Errorf("Get(%q) = %q", key, v)
+				}
+				c.Len()
+				c.Stats()
+			}
+		}()
+	}
+	wg.Wait()
+	if c.Len() > 10 {
+		t.Errorf("Len() = %d, want at most 10", c.Len())
+	}
+}
+
+// Checks the counters and hit ratio reported by Stats
+func TestStats(t *testing.T) {
+	c := NewCache[string](2)
+	if s := c.Stats(); s != (CacheStats{}) {
+		t.Fatalf("Stats() of a new cache = %+v", s)
+	}
+	c.Set("a", "1")
+	c.Get("a")
+	c.Get("a")
+	c.Get("b")
+	if s := c.Stats(); s.Hits != 2 || s.Misses != 1 || s.HitRatio != 2.0/3 {
+		t.Errorf("Stats() = %+v, want 2 hits and 1 miss", s)
+	}
+}
+
+// Checks that entries expire after the TTL and are then removed
+func TestTTL(t *testing.T) {
+	c := NewCacheWithTTL[string](10, 50*time.Millisecond)
+	c.Set("a", "1")
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a missing before the TTL")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Error("a not expired after the TTL")
+	}
+	if keys := c.Keys(); len(keys) != 0 {
+		t.Errorf("Keys() = %v after expiry, want none", keys)
+	}
+}
+
+// Checks Delete results and that deleted keys leave the eviction order
+func TestDelete(t *testing.T) {
+	c := NewCache[string](4)
+	setAll(c, "a", "b", "c", "d")
+	for _, tt := range []struct {
+		key  string
+		want bool
+	}{{"a", true}, {"c", true}, {"zz", false}, {"a", false}} {
+		if got := c.Delete(tt.key); got != tt.want {
+			t.Errorf("Delete(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+	if got := c.Keys(); !slices.Equal(got, []string{"b", "d"}) {
+		t.Errorf("Keys() = %v, want [b d]", got)
+	}
+	setAll(c, "e", "f", "g")
+	if got := c.Keys(); !slices.Equal(got, []string{"d", "e", "f", "g"}) {
+		t.Errorf("Keys() = %v, want b evicted first", got)
+	}
+}
+
+// Checks Clear, Len, Cap and Fullness
+func TestLenCapFullness(t *testing.T) {
+	c := NewCache[string](4)
+	if c.Cap() != 4 || c.Fullness() != 0 {
+		t.Fatalf("empty cache: Cap() = %d, Fullness() = %v", c.Cap(), c.Fullness())
+	}
+	for i, want := range []float64{0.25, 0.5, 0.75, 1, 1} {
+		c.Set(fmt.Sprint(i), "v")
+		if got := c.Fullness(); got != want {
+			t.Errorf("after %d sets Fullness() = %v, want %v", i+1, got, want)
+		}
+	}
+	c.Resize(8)
+	if c.Cap() != 8 || c.Fullness() != 0.5 {
+		t.Errorf("after Resize(8): Cap() = %d, Fullness() = %v", c.Cap(), c.Fullness())
+	}
+	c.Clear()
+	if c.Len() != 0 {
+		t.Errorf("Len() = %d after Clear", c.Len())
+	}
+	c.Set("a", "1")
+	if v, _ := c.Get("a"); v != "1" {
+		t.Errorf("Get(a) = %q after Clear", v)
+	}
+	u := NewCache[string](-1)
+	u.Set("a", "b")
+	if u.Cap() != 0 || u.Fullness() != 0 {
+		t.Errorf("unbounded: Cap() = %d, Fullness() = %v", u.Cap(), u.Fullness())
+	}
+}
+
+// Checks that Resize evicts by recency down to the new size
+func TestResize(t *testing.T) {
+	c := NewCache[string](10)
+	for i := 0; i < 10; i++ {
+		c.Set(fmt.Sprint(i), "v")
+	}
+	c.Get("2")
+	c.Resize(3)
+	if got := c.Keys(); !slices.Equal(got, []string{"8", "9", "2"}) {
+		t.Errorf("Keys() = %v, want [8 9 2]", got)
+	}
+}
+
+// Checks that updating a key replaces its value and makes it most recent
+func TestUpsert(t *testing.T) {
+	c := NewCache[string](2)
+	c.Set("a", "v1")
+	c.Set("b", "x")
+	c.Set("a", "v2")
+	if v, _ := c.Get("a"); v != "v2" || c.Len() != 2 {
+		t.Fatalf("Get(a) = %q, Len() = %d", v, c.Len())
+	}
+	c.Set("c", "x")
+	if c.Contains("b") {
+		t.Error("b should be evicted")
+	}
+}
+
+// Checks that a size of zero or less never evicts
+func TestUnbounded(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		c := NewCache[string](n)
+		for i := 0; i < 1000; i++ {
+			c.Set(fmt.Sprint(i), "v")
+		}
+		if c.Len() != 1000 {
+			t.Errorf("NewCache(%d): Len() = %d, want 1000", n, c.Len())
+		}
+	}
+}
+
+// Checks when OnEvict runs, and that it may call back into the cache
+func TestOnEvict(t *testing.T) {
+	c := NewCache[string](2)
+	var got []string
+	c.OnEvict = func(key, value string) {
+		got = append(got, key+"="+value)
+		c.Len()
+	}
+	c.Set("a", "1")
+	c.Set("b", "2")
+	c.Set("c", "3")
+	c.Delete("b")
+	if want := []string{"a=1"}; !slices.Equal(got, want) {
+		t.Fatalf("evicted %v, want %v", got, want)
+	}
+	c.NotifyOnDelete = true
+	c.Delete("c")
+	c.Set("x", "1")
+	c.Set("y", "1")
+	c.Resize(1)
+	if want := []string{"a=1", "c=3", "x=1"}; !slices.Equal(got, want) {
+		t.Errorf("evicted %v, want %v", got, want)
+	}
+}
+
+// Checks that Keys lists the eviction order and returns a copy
+func TestKeys(t *testing.T) {
+	c := NewCache[string](3)
+	setAll(c, "a", "b", "c")
+	c.Get("a")
+	keys := c.Keys()
+	if !slices.Equal(keys, []string{"b", "c", "a"}) {
+		t.Fatalf("Keys() = %v, want [b c a]", keys)
+	}
+	keys[0] = "zz"
+	if got := c.Keys(); !slices.Equal(got, []string{"b", "c", "a"}) {
+		t.Errorf("Keys() = %v after changing the returned slice", got)
+	}
+}
+
+// Checks that Contains and Peek neither promote keys nor count hits
+func TestContainsPeek(t *testing.T) {
+	c := NewCache[string](2)
+	c.Set("a", "1")
+	c.Set("b", "2")
+	if !c.Contains("a") || c.Contains("z") {
+		t.Fatal("Contains reports the wrong keys")
+	}
+	if v, ok := c.Peek("a"); !ok || v != "1" {
+		t.Fatalf("Peek(a) = %q, %v", v, ok)
+	}
+	c.Set("c", "3")
+	if c.Contains("a") || !c.Contains("b") {
+		t.Error("Contains or Peek promoted a")
+	}
+	if s := c.Stats(); s.Hits != 0 || s.Misses != 0 {
+		t.Errorf("Stats() = %+v, want no hits or misses", s)
+	}
+}
+
+// Checks the eviction order of the built-in policies after a Get of the oldest key
+func TestPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy EvictionPolicy
+		want   []string
+	}{
+		{"lru", NewLRUPolicy(), []string{"c", "a", "d"}},
+		{"fifo", NewFIFOPolicy(), []string{"b", "c", "d"}},
+		{"lfu", NewLFUPolicy(), []string{"c", "d", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCacheWithPolicy[string](3, tt.policy)
+			setAll(c, "a", "b", "c")
+			c.Get("a")
+			c.Set("d", "d")
+			if got := c.Keys(); !slices.Equal(got, tt.want) {
+				t.Errorf("Keys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Checks the LRU and FIFO order of a large cache against a plain slice model
+func TestPolicyOrderLarge(t *testing.T) {
+	tests := []struct {
+		name      string
+		newPolicy func() EvictionPolicy
+		touch     bool
+	}{
+		{"lru", NewLRUPolicy, true},
+		{"fifo", NewFIFOPolicy, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCacheWithPolicy[string](1000, tt.newPolicy())
+			var model []string
+			for i := 0; i < 5000; i++ {
+				key := fmt.Sprint(i)
+				c.Set(key, "v")
+				if model = append(model, key); len(model) > 1000 {
+					model = model[1:]
+				}
+				key = fmt.Sprint(i - 500)
+				c.Get(key)
+				if j := slices.Index(model, key); j >= 0 && tt.touch {
+					model = append(slices.Delete(model, j, j+1), key)
+				}
+			}
+			if got := c.Keys(); !slices.Equal(got, model) {
+				t.Fatalf("Keys() differs from the model: got %d keys from %v, want %d from %v", len(got), got[0], len(model), model[0])
+			}
+		})
+	}
+}
+
+// Checks that the LFU policy keeps a frequently read key over newer ones
+func TestLFU(t *testing.T) {
+	c := NewCacheWithPolicy[string](3, NewLFUPolicy())
+	c.Set("hot", "1")
+	for i := 0; i < 10; i++ {
+		c.Get("hot")
+	}
+	for i := 0; i < 10; i++ {
+		c.Set(fmt.Sprint(i), "x")
+	}
+	if got := c.Keys(); !slices.Equal(got, []string{"8", "9", "hot"}) {
+		t.Errorf("Keys() = %v, want [8 9 hot]", got)
+	}
+}
+
+// Checks that a saved cache loads back with its entries and order
+func TestSaveLoad(t *testing.T) {
+	c := NewCache[string](5)
+	c.Set("a", "1")
+	c.Set("b", "2")
+	c.Set("c", "3")
+	c.Get("a")
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	if err := c.SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCacheFromFile[string](path, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := loaded.Keys(), c.Keys(); !slices.Equal(got, want) {
+		t.Errorf("loaded Keys() = %v, want %v", got, want)
+	}
+	if v, _ := loaded.Get("b"); v != "2" {
+		t.Errorf("loaded Get(b) = %q, want 2", v)
+	}
+}
+
+// Checks the byte bound of NewCacheBytes
+func TestBytes(t *testing.T) {
+	c := NewCacheBytes[string](10)
+	c.Set("a", "1234")
+	c.Set("b", "1234")
+	if c.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", c.Len())
+	}
+	c.Get("a")
+	c.Set("c", "1")
+	if got := c.Keys(); !slices.Equal(got, []string{"a", "c"}) || c.bytes != 7 {
+		t.Fatalf("Keys() = %v with %d bytes, want [a c] with 7", got, c.bytes)
+	}
+	c.Set("a", "123456789")
+	if got := c.Keys(); !slices.Equal(got, []string{"a"}) || c.bytes != 10 {
+		t.Errorf("Keys() = %v with %d bytes, want [a] with 10", got, c.bytes)
+	}
+}
+
+// Checks that an entry larger than the byte bound is not stored and keeps the rest
+func TestBytesOversized(t *testing.T) {
+	c := NewCacheBytes[string](10)
+	c.Set("a", "1")
+	c.Set("b", "2")
+	c.Set("big", strings.Repeat("x", 20))
+	if c.Len() != 2 || c.Contains("big") || c.bytes != 4 {
+		t.Fatalf("Keys() = %v with %d bytes, want [a b] with 4", c.Keys(), c.bytes)
+	}
+	c.Set("a", strings.Repeat("x", 20))
+	if c.Contains("a") || !c.Contains("b") || c.bytes != 2 {
+		t.Errorf("Keys() = %v with %d bytes, want [b] with 2", c.Keys(), c.bytes)
+	}
+}
+
+// Checks a cache instantiated with []byte values
+func TestGenericBytes(t *testing.T) {
+	c := NewCache[[]byte](2)
+	c.Set("a", []byte{1, 2})
+	c.Set("b", []byte{3})
+	c.Get("a")
+	c.Set("c", nil)
+	if v, ok := c.Get("a"); !ok || len(v) != 2 || c.Contains("b") {
+		t.Fatalf("Get(a) = %v, %v", v, ok)
+	}
+	if v, ok := c.Get("zz"); ok || v != nil {
+		t.Errorf("Get(zz) = %v, %v, want nil, false", v, ok)
+	}
+	b := NewCacheBytes[[]byte](10)
+	b.Set("k1", make([]byte, 4))
+	b.Set("k2", make([]byte, 4))
+	if b.Len() != 1 || !b.Contains("k2") {
+		t.Errorf("Keys() = %v, want [k2]", b.Keys())
+	}
+}
+
+// Checks that a sharded cache stays within its size and keeps every value
+func TestSharded(t *testing.T) {
+	c := NewShardedCache[string](100, 8)
+	for i := 0; i < 1000; i++ {
+		c.Set(fmt.Sprint(i), "v")
+	}
+	if c.Len() > 100 || c.Len() < 80 {
+		t.Errorf("Len() = %d, want 80 to 100", c.Len())
+	}
+	d := NewShardedCache[string](1000, 8)
+	for i := 0; i < 500; i++ {
+		d.Set(fmt.Sprint(i), fmt.Sprint(i))
+	}
+	for i := 0; i < 500; i++ {
+		if v, ok := d.Get(fmt.Sprint(i)); !ok || v != fmt.Sprint(i) {
+			t.Fatalf("Get(%d) = %q, %v", i, v, ok)
+		}
+	}
+	if n := len(NewShardedCache[string](3, 8).shards); n != 3 {
+		t.Errorf("got %d shards for 3 entries, want 3", n)
+	}
+}
+
+// Checks LeastRecent and MostRecent under the LRU and FIFO policies
+func TestEndpoints(t *testing.T) {
+	c := NewCache[string](3)
+	if _, _, ok := c.LeastRecent(); ok {
+		t.Fatal("LeastRecent of an empty cache reported an entry")
+	}
+	setAll(c, "a", "b", "c")
+	c.Get("a")
+	if k, v, ok := c.LeastRecent(); !ok || k != "b" || v != "b" {
+		t.Errorf("LeastRecent() = %q, %q, %v", k, v, ok)
+	}
+	if k, _, _ := c.MostRecent(); k != "a" {
+		t.Errorf("MostRecent() = %q, want a", k)
+	}
+	f := NewCacheWithPolicy[string](3, NewFIFOPolicy())
+	setAll(f, "a", "b")
+	f.Get("a")
+	if k, _, _ := f.LeastRecent(); k != "a" {
+		t.Errorf("FIFO LeastRecent() = %q, want a", k)
+	}
+	if k, _, _ := f.MostRecent(); k != "b" {
+		t.Errorf("FIFO MostRecent() = %q, want b", k)
+	}
+}
+
+// Checks that hashed keys are stored short and that colliding keys stay apart
+func TestHashedCache(t *testing.T) {
+	a := strings.Repeat("10", 100000) + "0"
+	b := strings.Repeat("10", 100000) + "1"
+	c := NewHashedCache[string](10, nil)
+	c.Set(a, "A")
+	c.Set(b, "B")
+	for key, want := range map[string]string{a: "A", b: "B"} {
+		if v, ok := c.Get(key); !ok || v != want {
+			t.Errorf("Get = %q, %v, want %q", v, ok, want)
+		}
+	}
+	for _, key := range c.Keys() {
+		if len(key) > 9 {
+			t.Errorf("stored a key of %d bytes", len(key))
+		}
+	}
+
+	// A constant hash makes every key collide
+	cc := NewHashedCache[string](3, func(string) uint64 { return 7 })
+	cc.Set("x", "1")
+	cc.Set("y", "2")
+	cc.Set("z", "3")
+	for key, want := range map[string]string{"x": "1", "y": "2", "z": "3"} {
+		if v, ok := cc.Get(key); !ok || v != want {
+			t.Errorf("Get(%q) = %q, %v, want %q", key, v, ok, want)
+		}
+	}
+	if _, ok := cc.Get("w"); ok {
+		t.Error("Get(w) found a key never set")
+	}
+	cc.Set("y", "22")
+	if v, _ := cc.Peek("y"); v != "22" || cc.Len() != 3 {
+		t.Errorf("Peek(y) = %q with Len() = %d", v, cc.Len())
+	}
+	if !cc.Delete("x") || cc.Contains("x") || !cc.Contains("z") {
+		t.Error("Delete(x) removed the wrong key")
+	}
+	cc.Set("w", "4")
+	cc.Set("v", "5")
+	if v, ok := cc.Get("v"); !ok || v != "5" || cc.Len() != 3 {
+		t.Errorf("Get(v) = %q, %v with Len() = %d", v, ok, cc.Len())
+	}
+}
+
+// Checks that concurrent GetOrSet calls for one key compute it once
+func TestGetOrSet(t *testing.T) {
+	c := NewCache[string](10)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	results := make([]string, 20)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.GetOrSet("k", func() (string, error) {
+				calls.Add(1)
+				<-release
+				return "v", nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = v
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if v, _ := c.GetOrSet("other", func() (string, error) { return "o", nil }); v != "o" {
+		t.Fatalf("GetOrSet(other) = %q while k is pending", v)
+	}
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Errorf("compute ran %d times, want 1", calls.Load())
+	}
+	for _, v := range results {
+		if v != "v" {
+			t.Fatalf("results = %v", results)
+		}
+	}
+	if s := c.Stats(); s.Misses != 2 || s.Hits != 19 {
+		t.Errorf("Stats() = %+v, want 19 hits and 2 misses", s)
+	}
+	_, err := c.GetOrSet("bad", func() (string, error) { return "", errors.New("failed") })
+	if err == nil || c.Contains("bad") {
+		t.Errorf("GetOrSet(bad) = %v, stored = %v", err, c.Contains("bad"))
+	}
+}
+
+// Checks that the partitioned policy evicts from the largest partition
+func TestPartitioned(t *testing.T) {
+	c := NewCacheWithPolicy[string](6, NewPartitionedPolicy(PartitionBySize(Options{}), NewLRUPolicy))
+	c.Set("2:1010", "hot")
+	c.Set("2:0101", "hot2")
+	for i := 0; i < 50; i++ {
+		c.Set(fmt.Sprintf("3:%09b", i), "x")
+		c.Get("2:1010")
+	}
+	if c.Len() != 6 || !c.Contains("2:1010") || !c.Contains("2:0101") {
+		t.Fatalf("Keys() = %v, want both 2x2 rows kept", c.Keys())
+	}
+	keys := c.Keys()
+	if oldest, _, _ := c.LeastRecent(); keys[0] != oldest {
+		t.Errorf("LeastRecent() = %q, want Keys()[0] = %q", oldest, keys[0])
+	}
+	var evicted []string
+	c.OnEvict = func(key, _ string) { evicted = append(evicted, key) }
+	c.Resize(1)
+	if !slices.Equal(evicted, keys[:5]) {
+		t.Errorf("evicted %v, want %v", evicted, keys[:5])
+	}
+}
+
+// Checks the insertion time and access count reported by EntryInfo
+func TestEntryInfo(t *testing.T) {
+	c := NewCache[string](2)
+	before := time.Now()
+	c.Set("a", "1")
+	c.Set("b", "2")
+	if at, n, ok := c.EntryInfo("a"); !ok || n != 0 || at.Before(before) {
+		t.Fatalf("EntryInfo(a) = %v, %d, %v", at, n, ok)
+	}
+	c.Get("a")
+	c.Get("a")
+	c.GetOrSet("a", nil)
+	c.Peek("a")
+	if _, n, _ := c.EntryInfo("a"); n != 3 {
+		t.Errorf("accesses = %d, want 3", n)
+	}
+	c.EntryInfo("b")
+	c.Set("c", "3")
+	if _, _, ok := c.EntryInfo("b"); ok {
+		t.Error("EntryInfo(b) promoted b")
+	}
+	c.Set("a", "new")
+	if _, n, _ := c.EntryInfo("a"); n != 0 {
+		t.Errorf("accesses = %d after an update, want 0", n)
+	}
+}
+
+// Checks that MergeStats sums the counters of several caches
+func TestMergeStats(t *testing.T) {
+	var caches []*Cache[string]
+	for i := 0; i < 3; i++ {
+		c := NewCache[string](4)
+		c.Set("a", "x")
+		for j := 0; j <= i; j++ {
+			c.Get("a")
+		}
+		c.Get("missing")
+		caches = append(caches, c)
+	}
+	if s := MergeStats(caches...); s.Hits != 6 || s.Misses != 3 || s.HitRatio != 6.0/9 {
+		t.Errorf("MergeStats() = %+v", s)
+	}
+	if s := MergeStats[string](); s != (CacheStats{}) {
+		t.Errorf("MergeStats() of no caches = %+v", s)
+	}
+}
+
+// Checks the recency rank returned by GetWithRank
+func TestGetWithRank(t *testing.T) {
+	for _, c := range []*Cache[string]{NewCache[string](10), NewHashedCache[string](10, nil)} {
+		setAll(c, "a", "b", "c", "d")
+		c.Get("b")
+		c.Get("a")
+		tests := []struct {
+			key  string
+			rank int
+			ok   bool
+		}{{"c", 3, true}, {"c", 0, true}, {"b", 2, true}, {"zz", 0, false}}
+		for _, tt := range tests {
+			if _, rank, ok := c.GetWithRank(tt.key); rank != tt.rank || ok != tt.ok {
+				t.Errorf("GetWithRank(%q) = %d, %v, want %d, %v", tt.key, rank, ok, tt.rank, tt.ok)
+			}
+		}
+	}
+}
+
+// Checks the ranking of TopKeys under the LRU and LFU policies
+func TestTopKeys(t *testing.T) {
+	for _, c := range []*Cache[string]{NewCache[string](10), NewCacheWithPolicy[string](10, NewLFUPolicy())} {
+		setAll(c, "a", "b", "c", "d", "e")
+		for key, n := range map[string]int{"a": 1, "b": 5, "c": 3, "d": 3} {
+			for i := 0; i < n; i++ {
+				c.Get(key)
+			}
+		}
+		c.Peek("e")
+		if got, want := c.TopKeys(3), []KeyCount{{"b", 5}, {"c", 3}, {"d", 3}}; !slices.Equal(got, want) {
+			t.Errorf("TopKeys(3) = %v, want %v", got, want)
+		}
+		if all := c.TopKeys(100); len(all) != 5 || all[4] != (KeyCount{"e", 0}) {
+			t.Errorf("TopKeys(100) = %v", all)
+		}
+		if got := c.TopKeys(0); got != nil {
+			t.Errorf("TopKeys(0) = %v, want nil", got)
+		}
+	}
+}
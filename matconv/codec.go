@@ -0,0 +1,374 @@
+package matconv
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// bitLengthSep separates a packed value from its original bit count. The count
+// is only written when the bits do not fill the packed bytes, e.g. "10110" -> "B0.5",
+// which also records any alignment padding.
+const bitLengthSep = "."
+
+// Packs a binary string into bytes, most significant bit first unless lsbFirst,
+// zero padding the unused bits of the last byte
+func packBits(binStr string, lsbFirst bool) []byte {
+	binBytes := make([]byte, (len(binStr)+7)/8)
+	for i := 0; i < len(binStr); i++ {
+		binBytes[i/8] |= (binStr[i] - '0') << bitShift(i, lsbFirst)
+	}
+	return binBytes
+}
+
+// Unpacks the first n bits of bytes into a binary string, in the order packBits used
+func unpackBits(bytes []byte, n int, lsbFirst bool) string {
+	var binStr strings.Builder
+	binStr.Grow(n)
+	for i := 0; i < n; i++ {
+		binStr.WriteByte('0' + bytes[i/8]>>bitShift(i, lsbFirst)&1)
+	}
+	return binStr.String()
+}
+
+// Returns the position within its byte of bit i of a binary string
+func bitShift(i int, lsbFirst bool) int {
+	if lsbFirst {
+		return i % 8
+	}
+	return 7 - i%8
+}
+
+// Appends the original bit count to an encoded value of numBytes bytes when they are padded
+func withBitLength(encoded string, n, numBytes int) string {
+	if n == numBytes*8 {
+		return encoded
+	}
+	return encoded + bitLengthSep + strconv.Itoa(n)
+}
+
+// Splits an encoded value into its payload and bit count; n is -1 when no count was recorded
+func splitBitLength(value string) (encoded string, n int, err error) {
+	encoded, count, found := strings.Cut(value, bitLengthSep)
+	if !found {
+		return encoded, -1, nil
+	}
+	n, err = strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return "", 0, fmt.Errorf("invalid bit length %q", count)
+	}
+	return encoded, n, nil
+}
+
+// Checks a recorded bit count against the number of decoded bytes, which are
+// padded to a multiple of align
+func resolveBitLength(n, numBytes, align int) (int, error) {
+	if numBytes%align != 0 {
+		return 0, fmt.Errorf("%d decoded bytes are not aligned to %d", numBytes, align)
+	}
+	if n < 0 {
+		return numBytes * 8, nil
+	}
+	if alignedSize(n, align) != numBytes {
+		return 0, fmt.Errorf("bit length %d does not match %d decoded bytes", n, numBytes)
+	}
+	return n, nil
+}
+
+// Returns the number of bytes n bits occupy once padded to a multiple of align
+func alignedSize(n, align int) int {
+	numBytes := (n + 7) / 8
+	return (numBytes + align - 1) / align * align
+}
+
+// Checks that a binary string contains only 0 and 1
+func validateBits(binStr string) error {
+	for i := 0; i < len(binStr); i++ {
+		if binStr[i] != '0' && binStr[i] != '1' {
+			return fmt.Errorf("%w character %q at index %d", ErrInvalidBinary, binStr[i], i)
+		}
+	}
+	return nil
+}
+
+// Value encodings for the packed bytes. Octal and decimal treat the bytes as a
+// big-endian integer, which drops leading zeros, so they always record the bit length.
+// RLE does not pack at all: it writes the runs of the binary string, e.g. "0x5,1x3".
+const (
+	FormatHex    = "hex"
+	FormatBase64 = "base64"
+	FormatOct    = "oct"
+	FormatDec    = "dec"
+	FormatRLE    = "rle"
+)
+
+// Formats lists the valid values of Options.Format
+var Formats = []string{FormatHex, FormatBase64, FormatOct, FormatDec, FormatRLE}
+
+// valueAlphabet returns the characters that encoded values of format may contain,
+// besides bitLengthSep
+func valueAlphabet(format string) string {
+	switch format {
+	case FormatBase64:
+		return "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/="
+	case FormatOct:
+		return "01234567"
+	case FormatDec:
+		return "0123456789"
+	case FormatRLE:
+		return "0123456789" + rleCountSep + rleRunSep
+	case FormatRaw:
+		return "01"
+	default:
+		return "0123456789ABCDEFabcdef"
+	}
+}
+
+// Separators of the run-length encoding: runs are joined by rleRunSep and
+// each run is the bit, rleCountSep, then the run length
+const (
+	rleRunSep   = ","
+	rleCountSep = "x"
+)
+
+// Encodes a validated binary string as comma-separated bitxcount runs
+func encodeRLE(binStr string) string {
+	var runs strings.Builder
+	for i := 0; i < len(binStr); {
+		j := i + 1
+		for j < len(binStr) && binStr[j] == binStr[i] {
+			j++
+		}
+		if i > 0 {
+			runs.WriteString(rleRunSep)
+		}
+		runs.WriteByte(binStr[i])
+		runs.WriteString(rleCountSep)
+		runs.WriteString(strconv.Itoa(j - i))
+		i = j
+	}
+	return runs.String()
+}
+
+// Expands runs written by encodeRLE back into the binary string
+func decodeRLE(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	var binStr strings.Builder
+	for _, run := range strings.Split(value, rleRunSep) {
+		bit, count, found := strings.Cut(run, rleCountSep)
+		n, err := strconv.Atoi(count)
+		if !found || (bit != "0" && bit != "1") || err != nil || n < 1 {
+			return "", fmt.Errorf("invalid run %q in rle value %q", run, value)
+		}
+		binStr.WriteString(strings.Repeat(bit, n))
+	}
+	return binStr.String(), nil
+}
+
+// integerBase returns the numeric base of an integer format, or 0 for byte formats
+func integerBase(format string) int {
+	switch format {
+	case FormatOct:
+		return 8
+	case FormatDec:
+		return 10
+	}
+	return 0
+}
+
+// EncodeBits packs a binary string into bytes and encodes them as opts describes
+func EncodeBits(binStr string, opts Options) (string, error) {
+	if err := validateBits(binStr); err != nil {
+		return "", err
+	}
+	if opts.Format == FormatRLE {
+		return encodeRLE(binStr), nil
+	}
+	packed := packBits(binStr, opts.LSBFirst)
+	packed = append(packed, make([]byte, alignedSize(len(binStr), opts.align())-len(packed))...)
+	if base := integerBase(opts.Format); base != 0 {
+		encoded := new(big.Int).SetBytes(packed).Text(base)
+		return encoded + bitLengthSep + strconv.Itoa(len(binStr)), nil
+	}
+	var encoded string
+	switch opts.Format {
+	case FormatBase64:
+		encoded = base64.StdEncoding.EncodeToString(packed)
+	default:
+		encoded = hex.EncodeToString(packed)
+		if !opts.LowerHex {
+			encoded = strings.ToUpper(encoded)
+		}
+	}
+	return withBitLength(encoded, len(binStr), len(packed)), nil
+}
+
+// DecodeBits decodes a value produced by EncodeBits back into its binary string
+func DecodeBits(value string, opts Options) (string, error) {
+	format := opts.Format
+	if format == FormatRLE {
+		return decodeRLE(value)
+	}
+	encoded, n, err := splitBitLength(value)
+	if err != nil {
+		return "", err
+	}
+	var bytes []byte
+	if base := integerBase(format); base != 0 {
+		if n < 0 {
+			return "", fmt.Errorf("%s value %q has no bit length", format, encoded)
+		}
+		size := alignedSize(n, opts.align())
+		x, ok := new(big.Int).SetString(encoded, base)
+		if !ok || x.Sign() < 0 || x.BitLen() > size*8 {
+			return "", fmt.Errorf("invalid %s value %q for %d bits", format, encoded, n)
+		}
+		return unpackBits(x.FillBytes(make([]byte, size)), n, opts.LSBFirst), nil
+	}
+	switch format {
+	case FormatBase64:
+		bytes, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", fmt.Errorf("invalid base64 value %q: %w", encoded, err)
+		}
+	default:
+		if err := validateHex(encoded); err != nil {
+			return "", err
+		}
+		bytes, err = hex.DecodeString(encoded)
+		if err != nil {
+			return "", fmt.Errorf("%w value %q: %w", ErrInvalidHex, encoded, err)
+		}
+	}
+	n, err = resolveBitLength(n, len(bytes), opts.align())
+	if err != nil {
+		return "", err
+	}
+	return unpackBits(bytes, n, opts.LSBFirst), nil
+}
+
+// RoundTrip encodes binStr with EncodeBits and decodes the result with DecodeBits,
+// returning an error if either step fails or the decoded bits differ. It gives
+// property tests and fuzz targets a single check for every format and option.
+func RoundTrip(binStr string, opts Options) error {
+	encoded, err := EncodeBits(binStr, opts)
+	if err != nil {
+		return err
+	}
+	decoded, err := DecodeBits(encoded, opts)
+	if err != nil {
+		return fmt.Errorf("decoding %q: %w", encoded, err)
+	}
+	if decoded != binStr {
+		return fmt.Errorf("%q round-tripped through %q to %q", binStr, encoded, decoded)
+	}
+	return nil
+}
+
+// BinToHex converts a binary string to its hexadecimal representation
+func BinToHex(binStr string) (string, error) {
+	return EncodeBits(binStr, Options{})
+}
+
+// Checks that hexStr holds only hex digits and a whole number of bytes, so that a
+// truncated value is reported before decoding
+func validateHex(hexStr string) error {
+	for i := 0; i < len(hexStr); i++ {
+		if c := hexStr[i]; !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return fmt.Errorf("%w character %q at index %d in %q", ErrInvalidHex, c, i, hexStr)
+		}
+	}
+	if len(hexStr)%2 != 0 {
+		return fmt.Errorf("%w value %q: odd length, %d digits do not make whole bytes", ErrInvalidHex, hexStr, len(hexStr))
+	}
+	return nil
+}
+
+// decodeChunk is how many packed bytes DecodeHexTo unpacks per write
+const decodeChunk = 4096
+
+// DecodeHexTo decodes a hex value produced by EncodeBits like DecodeBits, ignoring
+// opts.Format, but writes the binary digits to w a chunk at a time instead of building
+// the whole string. The value is checked before anything is written. It returns the
+// number of bytes written.
+func DecodeHexTo(w io.Writer, value string, opts Options) (int, error) {
+	encoded, n, err := checkHexValue(value, opts.align())
+	if err != nil {
+		return 0, err
+	}
+	return writeHexBits(w, encoded, n, opts.LSBFirst)
+}
+
+// Splits a hex value into its digits and bit count, validating both
+func checkHexValue(value string, align int) (encoded string, n int, err error) {
+	encoded, n, err = splitBitLength(value)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := validateHex(encoded); err != nil {
+		return "", 0, err
+	}
+	n, err = resolveBitLength(n, len(encoded)/2, align)
+	return encoded, n, err
+}
+
+// Writes the first n bits of validated hex digits to w, decodeChunk bytes at a time
+func writeHexBits(w io.Writer, encoded string, n int, lsbFirst bool) (int, error) {
+	packed := make([]byte, decodeChunk)
+	bits := make([]byte, 0, decodeChunk*8)
+	written := 0
+	for start := 0; written < n; start += decodeChunk {
+		end := min(start+decodeChunk, len(encoded)/2)
+		hex.Decode(packed, []byte(encoded[start*2:end*2]))
+		bits = bits[:0]
+		for i := 0; i < (end-start)*8 && written+len(bits) < n; i++ {
+			bits = append(bits, '0'+packed[i/8]>>bitShift(i, lsbFirst)&1)
+		}
+		m, err := w.Write(bits)
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// HexToBin converts a hexadecimal string to its binary representation
+func HexToBin(hexStr string) (string, error) {
+	return DecodeBits(hexStr, Options{})
+}
+
+// selfTestVectors are known binary/hex pairs checked by SelfTest, covering whole bytes,
+// padded bit counts and the empty value
+var selfTestVectors = []struct{ bin, hex string }{
+	{"", ""},
+	{"00000000", "00"},
+	{"11111111", "FF"},
+	{"10110011", "B3"},
+	{"0000000100100011", "0123"},
+	{"1", "80.1"},
+	{"10110", "B0.5"},
+	{"1010101111001101111011110", "ABCDEF00.25"},
+}
+
+// SelfTest converts the embedded known-answer vectors with BinToHex and HexToBin and
+// returns the number of vectors checked, with an error listing every mismatch
+func SelfTest() (int, error) {
+	var errs []error
+	for _, v := range selfTestVectors {
+		if hex, err := BinToHex(v.bin); err != nil || hex != v.hex {
+			errs = append(errs, fmt.Errorf("BinToHex(%q) = %q, %v; want %q", v.bin, hex, err, v.hex))
+		}
+		if bin, err := HexToBin(v.hex); err != nil || bin != v.bin {
+			errs = append(errs, fmt.Errorf("HexToBin(%q) = %q, %v; want %q", v.hex, bin, err, v.bin))
+		}
+	}
+	return len(selfTestVectors), errors.Join(errs...)
+}
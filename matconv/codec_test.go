@@ -0,0 +1,281 @@
+package matconv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// Checks BinToHex and HexToBin at bit counts around a byte boundary
+func TestBinToHex(t *testing.T) {
+	tests := []struct {
+		bin string
+		hex string
+	}{
+		{"", ""},
+		{"1", "80.1"},
+		{"0", "00.1"},
+		{"1011001", "B2.7"},
+		{"10110011", "B3"},
+		{"101100111", "B380.9"},
+		{"000000001", "0080.9"},
+		{"10110", "B0.5"},
+	}
+	for _, tt := range tests {
+		hex, err := BinToHex(tt.bin)
+		if err != nil || hex != tt.hex {
+			t.Errorf("binToHex(%q) = %q, %v, want %q", tt.bin, hex, err, tt.hex)
+			continue
+		}
+		if bin, err := HexToBin(hex); err != nil || bin != tt.bin {
+			t.Errorf("hexToBin(%q) = %q, %v, want %q", hex, bin, err, tt.bin)
+		}
+	}
+}
+
+// Checks that HexToBin rejects bit counts that do not fit the decoded bytes
+func TestBitLengthErrors(t *testing.T) {
+	for _, hex := range []string{"B0.9", "B380.8", "B0.x", "B0.-1"} {
+		if bin, err := HexToBin(hex); err == nil {
+			t.Errorf("hexToBin(%q) = %q, want an error", hex, bin)
+		}
+	}
+}
+
+// Checks that invalid binary characters are reported with their index
+func TestInvalidBits(t *testing.T) {
+	tests := []struct {
+		bin  string
+		want string
+	}{
+		{"1012", "invalid binary character '2' at index 3"},
+		{"10 1", "invalid binary character ' ' at index 2"},
+	}
+	for _, tt := range tests {
+		if _, err := BinToHex(tt.bin); !errors.Is(err, ErrInvalidBinary) || err.Error() != tt.want {
+			t.Errorf("binToHex(%q) error = %v, want %q", tt.bin, err, tt.want)
+		}
+	}
+}
+
+// Checks that decode errors name the offending hex and its position
+func TestInvalidHex(t *testing.T) {
+	tests := []struct {
+		hex  string
+		want string
+	}{
+		{"B", `invalid hex value "B": odd length, 1 digits do not make whole bytes`},
+		{"B3A", `invalid hex value "B3A": odd length`},
+		{"BG1", `invalid hex character 'G' at index 1 in "BG1"`},
+		{"G0", `invalid hex character 'G' at index 0 in "G0"`},
+		{"B3Z1", `invalid hex character 'Z' at index 2 in "B3Z1"`},
+	}
+	for _, tt := range tests {
+		if _, err := HexToBin(tt.hex); !errors.Is(err, ErrInvalidHex) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("hexToBin(%q) error = %v, want it to contain %q", tt.hex, err, tt.want)
+		}
+	}
+}
+
+// Checks that every format decodes what it encodes, under each bit order and alignment
+func TestFormats(t *testing.T) {
+	rows := []string{"", "0", "1", "1011001", "10110011", "101100111", "0000000011", "00000000", strings.Repeat("10", 20)}
+	for _, format := range Formats {
+		for _, opts := range []Options{{}, {LSBFirst: true}, {Align: 4}, {LSBFirst: true, Align: 4}} {
+			opts.Format = format
+			for _, bits := range rows {
+				if err := RoundTrip(bits, opts); err != nil {
+					t.Errorf("%+v: %v", opts, err)
+				}
+			}
+		}
+	}
+	for _, tt := range []struct {
+		opts Options
+		want string
+	}{{Options{}, "8060.11"}, {Options{LSBFirst: true}, "0106.11"}, {Options{Align: 4}, "80600000.11"}} {
+		if got, _ := EncodeBits("10000000011", tt.opts); got != tt.want {
+			t.Errorf("%+v: EncodeBits(10000000011) = %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+	if got, _ := EncodeBits(strings.Repeat("1", 32), Options{Align: 4}); got != "FFFFFFFF" {
+		t.Errorf("aligned full value = %q, want FFFFFFFF", got)
+	}
+	for _, value := range []string{"B000.5", "B0000000.40"} {
+		if got, err := DecodeBits(value, Options{Align: 4}); err == nil {
+			t.Errorf("aligned DecodeBits(%q) = %q, want an error", value, got)
+		}
+	}
+	if got, _ := EncodeBits("10110011", Options{Format: FormatBase64}); got != "sw==" {
+		t.Errorf("base64 of 10110011 = %q, want sw==", got)
+	}
+	if got, err := DecodeBits("s===", Options{Format: FormatBase64}); err == nil {
+		t.Errorf("decodeBits(s===) = %q, want an error", got)
+	}
+}
+
+// Checks the octal and decimal encodings and their bit length checks
+func TestIntegerFormats(t *testing.T) {
+	for _, tt := range []struct{ bits, format, want string }{
+		{"0000000011", FormatDec, "192.10"},
+		{"0000000011", FormatOct, "300.10"},
+		{"10110011", FormatDec, "179.8"},
+		{"", FormatDec, "0.0"},
+	} {
+		if got, err := EncodeBits(tt.bits, Options{Format: tt.format}); err != nil || got != tt.want {
+			t.Errorf("encodeBits(%q, %s) = %q, %v, want %q", tt.bits, tt.format, got, err, tt.want)
+		}
+	}
+	for _, tt := range []struct{ value, format string }{
+		{"999.3", FormatDec}, {"192", FormatDec}, {"-1.8", FormatDec}, {"9.8", FormatOct},
+	} {
+		if got, err := DecodeBits(tt.value, Options{Format: tt.format}); err == nil {
+			t.Errorf("decodeBits(%q, %s) = %q, want an error", tt.value, tt.format, got)
+		}
+	}
+}
+
+// Checks that -lower emits lowercase hex and that decoding accepts either case
+func TestLowerHex(t *testing.T) {
+	if got, _ := EncodeBits("1010101111", Options{LowerHex: true}); got != "abc0.10" {
+		t.Errorf("lowercase EncodeBits = %q, want abc0.10", got)
+	}
+	for _, value := range []string{"abc0.10", "ABC0.10", "aBc0.10"} {
+		if got, err := DecodeBits(value, Options{}); err != nil || got != "1010101111" {
+			t.Errorf("decodeBits(%q) = %q, %v", value, got, err)
+		}
+	}
+	if got, _ := EncodeBits("10110011", Options{Format: FormatBase64, LowerHex: true}); got != "sw==" {
+		t.Errorf("-lower changed base64 to %q", got)
+	}
+}
+
+// Checks the run-length encoding, its malformed runs and that it beats hex on long runs
+func TestRLE(t *testing.T) {
+	bits := strings.Repeat("0", 500) + strings.Repeat("1", 300)
+	rle, _ := EncodeBits(bits, Options{Format: FormatRLE})
+	if rle != "0x500,1x300" {
+		t.Errorf("EncodeBits = %q, want 0x500,1x300", rle)
+	}
+	if hexed, _ := EncodeBits(bits, Options{}); len(rle) >= len(hexed) {
+		t.Errorf("RLE is %d bytes, hex %d", len(rle), len(hexed))
+	}
+	for _, value := range []string{"2x3", "0x0", "0x", "1x3,", "0-3"} {
+		if got, err := DecodeBits(value, Options{Format: FormatRLE}); err == nil {
+			t.Errorf("DecodeBits(%q) = %q, want an error", value, got)
+		}
+	}
+}
+
+// Checks that DecodeHexTo writes the same bits as DecodeBits for a value of many chunks
+func TestDecodeHexTo(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	var bits strings.Builder
+	for i := 0; i < 3*decodeChunk*8+5; i++ {
+		bits.WriteByte('0' + byte(rng.Intn(2)))
+	}
+	for _, opts := range []Options{{}, {LSBFirst: true, Align: 4}} {
+		enc, _ := EncodeBits(bits.String(), opts)
+		var out bytes.Buffer
+		n, err := DecodeHexTo(&out, enc, opts)
+		if err != nil || n != bits.Len() || out.String() != bits.String() {
+			t.Errorf("%+v: DecodeHexTo wrote %d bits, %v", opts, n, err)
+		}
+	}
+	var out bytes.Buffer
+	if _, err := DecodeHexTo(&out, "ABC", Options{}); !errors.Is(err, ErrInvalidHex) || out.Len() != 0 {
+		t.Errorf("DecodeHexTo(ABC) = %v after writing %d bytes", err, out.Len())
+	}
+}
+
+// Checks that SelfTest passes on every vector and reports a mismatching one
+func TestSelfTest(t *testing.T) {
+	if n, err := SelfTest(); err != nil || n == 0 || n != len(selfTestVectors) {
+		t.Fatalf("SelfTest() = %d, %v, want %d, nil", n, err, len(selfTestVectors))
+	}
+	defer func(vectors []struct{ bin, hex string }) { selfTestVectors = vectors }(selfTestVectors)
+	selfTestVectors = []struct{ bin, hex string }{{"10110011", "B4"}}
+	if _, err := SelfTest(); err == nil || !strings.Contains(err.Error(), `BinToHex("10110011")`) {
+		t.Errorf("SelfTest() with a bad vector = %v, want a BinToHex mismatch", err)
+	}
+}
+
+// errWriter fails every write
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) { return 0, io.ErrShortWrite }
+
+// Checks that DecodeHexTo returns the error of the writer
+func TestDecodeHexToWriteError(t *testing.T) {
+	if _, err := DecodeHexTo(errWriter{}, "B3", Options{}); err != io.ErrShortWrite {
+		t.Errorf("DecodeHexTo error = %v, want %v", err, io.ErrShortWrite)
+	}
+}
+
+// Fuzzes RoundTrip over every format and bit order, and BinToHex against HexToBin
+func FuzzRoundTrip(f *testing.F) {
+	for _, seed := range []string{"", "0", "1", "11111111", "000000001"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, bits string) {
+		if validateBits(bits) != nil {
+			if err := RoundTrip(bits, Options{}); !errors.Is(err, ErrInvalidBinary) {
+				t.Fatalf("RoundTrip(%q) = %v, want ErrInvalidBinary", bits, err)
+			}
+			return
+		}
+		for _, format := range Formats {
+			for _, opts := range []Options{{Format: format}, {Format: format, LSBFirst: true, Align: 4}} {
+				if err := RoundTrip(bits, opts); err != nil {
+					t.Fatalf("%+v: %v", opts, err)
+				}
+			}
+		}
+		encoded, err := BinToHex(bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if back, err := HexToBin(encoded); err != nil || back != bits {
+			t.Fatalf("HexToBin(%q) = %q, %v, want %q", encoded, back, err, bits)
+		}
+	})
+}
+
+// hexToBinSprintf is the former HexToBin, which appended fmt.Sprintf("%08b") per byte
+func hexToBinSprintf(hexStr string) (string, error) {
+	decoded, err := hex.DecodeString(hexStr)
+	if err != nil {
+		return "", err
+	}
+	binStr := ""
+	for _, b := range decoded {
+		binStr += fmt.Sprintf("%08b", b)
+	}
+	return binStr, nil
+}
+
+// Compares HexToBin with the former fmt.Sprintf implementation on a 4KiB value
+func BenchmarkHexToBin(b *testing.B) {
+	value := strings.Repeat("B3", 4096)
+	want, _ := hexToBinSprintf(value)
+	if got, _ := HexToBin(value); got != want {
+		b.Fatal("hexToBin differs from the fmt.Sprintf implementation")
+	}
+	b.Run("sprintf", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			hexToBinSprintf(value)
+		}
+	})
+	b.Run("builder", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			HexToBin(value)
+		}
+	})
+}
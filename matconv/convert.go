@@ -0,0 +1,1649 @@
+// Package matconv converts matrixSize:binary lines into packed hex (or base64,
+// octal or decimal) values and back, optionally caching converted lines.
+//
+// A typical use converts a stream with a shared cache:
+//
+//	cache := matconv.NewCache[string](5000)
+//	summary, err := matconv.Convert(os.Stdin, os.Stdout, cache, matconv.Options{})
+//
+// and single values can be converted directly:
+//
+//	hex, _ := matconv.BinToHex("10110011") // "B3"
+//	bits, _ := matconv.HexToBin(hex)       // "10110011"
+package matconv
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Direction selects whether values are packed into hex or unpacked back to binary
+type Direction int
+
+const (
+	Compress Direction = iota
+	Decompress
+	// Auto picks the direction per line: values made only of 0 and 1 are compressed
+	// and anything else is decompressed, so an ambiguous value such as "10" is
+	// always read as binary
+	Auto
+)
+
+// Resolves Auto to the direction for value; other directions are returned as is
+func (dir Direction) resolve(value string) Direction {
+	if dir != Auto {
+		return dir
+	}
+	if validateBits(value) == nil {
+		return Compress
+	}
+	return Decompress
+}
+
+// Options controls how lines are converted
+type Options struct {
+	// Direction selects packing binary into hex or unpacking it back
+	Direction Direction
+	// LineWorkers converts the lines of a single input concurrently when above 1
+	LineWorkers int
+	// Delimiter separates the size and value fields; empty means ":". It must pass
+	// CheckDelimiter.
+	Delimiter string
+	// CRLF terminates output lines with "\r\n" instead of "\n"
+	CRLF bool
+	// BufferSize is the output buffer size in bytes; 0 uses the bufio default
+	BufferSize int
+	// Format is the encoding of packed values: "hex" (the default), "base64", "oct" or "dec";
+	// "raw" writes a binary file instead of text lines, see FormatRaw
+	Format string
+	// LowerHex emits lowercase hex digits; decoding accepts either case
+	LowerHex bool
+	// LSBFirst packs the first bit of each group of eight as the least significant
+	// bit of its byte instead of the most significant
+	LSBFirst bool
+	// Align pads the packed bytes of each value with zero bytes to a multiple of
+	// Align; 0 or 1 packs to the next byte only
+	Align int
+	// Checksum appends a CRC32 field when compressing and verifies it when decompressing
+	Checksum bool
+	// ValidateSize rejects binary values whose length does not match the matrix size:
+	// the input bits when compressing, the decoded bits when decompressing
+	ValidateSize bool
+	// NoClobber makes the file functions refuse to replace an existing output file
+	NoClobber bool
+	// Progress, when set, is called with the number of lines converted since its previous
+	// call, every progressInterval lines and once more when the conversion ends
+	Progress func(lines int)
+	// SkipErrors drops lines that fail to convert instead of stopping; they are still
+	// counted in Summary.Errors
+	SkipErrors bool
+	// OnSkip, when set, is called with the error for each line dropped by SkipErrors
+	OnSkip func(err error)
+	// TrimSpace trims surrounding whitespace, including a stray "\r", from each field
+	// and ignores blank lines
+	TrimSpace bool
+	// DryRun makes the file functions convert everything without creating or writing outputs
+	DryRun bool
+	// MaxLineSize is the longest input line accepted, in bytes; 0 keeps the
+	// bufio.Scanner default of 64KiB
+	MaxLineSize int
+	// SkipLines discards that many input lines before converting; line numbers in
+	// errors still count them
+	SkipLines int
+	// Resume makes the file functions append to an existing output file, skipping
+	// the input lines it already holds. It assumes one output line per input line,
+	// so it cannot be combined with SkipErrors or TrimSpace.
+	Resume bool
+	// Atomic makes the file functions write to a temporary file that replaces the
+	// output only when the conversion succeeds, so no partial output is left behind.
+	// Resumed and stdout outputs are still written in place.
+	Atomic bool
+	// Header writes a line such as "#format=hex;delim=:;bitorder=msb" before compressed
+	// output. Decompression applies such a line whenever the input starts with one.
+	Header bool
+	// SplitLines, when positive, makes the file functions write the output as chunks
+	// of at most SplitLines lines named outputFile+".000", ".001" and so on, each
+	// starting with the Header line if there is one. Chunks are written in place even
+	// with Atomic, and cannot be combined with Resume or a stdout output.
+	SplitLines int
+	// Sync makes the file functions sync output files to disk before closing them,
+	// and the directory after an Atomic rename. Stdout is never synced.
+	Sync bool
+	// AutoCache, when positive, samples that many lines at the start of each input and
+	// stops using the cache for the rest of it when fewer than autoCacheMinRepeats of
+	// them repeat an earlier line. Inputs this happens to are counted in Summary.Uncached.
+	// With LineWorkers the decision applies from the next batch of lines.
+	AutoCache int
+	// Limit, when positive, stops the conversion cleanly once that many lines have been
+	// converted, leaving the rest of the input unread
+	Limit int
+	// SizeField, when set, rewrites the matrix size field of each converted line, for
+	// example with SquareSize. It sees the field after any TrimSpace and ValidateSize.
+	SizeField func(matrixSize string) (string, error)
+	// OutputDelimiter separates the fields of output lines, including the fields carried
+	// after the value; empty uses Delimiter. It must pass CheckDelimiter.
+	OutputDelimiter string
+	// Dedup writes only the first occurrence of each converted line of an input, counting
+	// the dropped repeats in Summary.Duplicates. Every distinct line is kept in memory until
+	// the input ends, and long hex values are not decompressed by streaming. FormatRaw
+	// output is not deduplicated.
+	Dedup bool
+	// CommentPrefix, when set, makes conversions ignore empty lines and lines starting
+	// with it, such as "#", without counting them as errors. A first line is then only
+	// taken for a Header line if it starts with "#format=".
+	CommentPrefix string
+	// KeepComments copies the lines ignored by CommentPrefix or TrimSpace to the output
+	// unchanged instead of dropping them. They are not counted in Summary.Lines.
+	KeepComments bool
+	// Sample, when positive, writes a uniform random sample of Sample converted lines of
+	// each input, in input order, instead of all of them. The sample is chosen by reservoir
+	// sampling, so only the sampled lines are held in memory, and is written once the
+	// input ends. As with Dedup, long hex values are not decompressed by streaming.
+	Sample int
+	// Seed seeds the random choice of Sample, making the sample reproducible
+	Seed int64
+	// SortBySize holds every converted line of an input in memory and, once the input
+	// ends, writes them ordered by the number of bits their size field declares (N*N for
+	// "N", R*C for "RxC"), keeping the input order of equal sizes. Sizes that do not parse
+	// sort last. It applies after Sample. Lines kept by KeepComments are written as they
+	// are read, ahead of the sorted ones.
+	SortBySize bool
+	// Split, when set, splits the input into records instead of bufio.ScanLines, for
+	// example ScanNull for NUL-separated records. RecordSeparator should then be set to
+	// match, and a Header record is read up to the last byte of RecordSeparator.
+	// Split cannot be combined with Resume or SplitLines, which count newlines.
+	Split bufio.SplitFunc
+	// RecordSeparator, when set, terminates output records instead of "\n" or CRLF
+	RecordSeparator string
+	// Follow keeps reading at the end of the input, like tail -f: appended data is polled
+	// for every followInterval and each complete line is converted as it arrives, with
+	// the output flushed whenever the input is drained. The conversion then only ends when
+	// ctx is canceled. Lines are converted serially whatever LineWorkers is, and the file
+	// functions write the output in place even with Atomic.
+	Follow bool
+	// Transform, when set, rewrites the binary value of each line before it is encoded,
+	// for example reversing its bits. InverseTransform undoes it after decoding when
+	// decompressing. Both must be deterministic since converted lines may be cached, and
+	// setting InverseTransform stops long hex values from being decompressed by streaming.
+	Transform func(bits string) (string, error)
+	// InverseTransform, when set, rewrites each decoded binary value when decompressing
+	InverseTransform func(bits string) (string, error)
+}
+
+// delimiter returns the field separator, defaulting to ":"
+func (opts Options) delimiter() string {
+	if opts.Delimiter == "" {
+		return ":"
+	}
+	return opts.Delimiter
+}
+
+// CheckDelimiter returns an error if delim cannot separate the fields of lines converted
+// with opts: it is empty or shares a character with the binary or encoded values, their
+// bit length or the checksum, so that it would split a value apart.
+func CheckDelimiter(delim string, opts Options) error {
+	if delim == "" {
+		return errors.New("empty delimiter")
+	}
+	format := opts.Format
+	if format == "" {
+		format = FormatHex
+	}
+	chars := "01" + bitLengthSep + valueAlphabet(format)
+	if opts.Checksum {
+		chars += valueAlphabet(FormatHex)
+	}
+	if i := strings.IndexAny(delim, chars); i >= 0 {
+		return fmt.Errorf("delimiter %q contains %q, which occurs in %s values", delim, delim[i], format)
+	}
+	return nil
+}
+
+// checkDelimiters runs CheckDelimiter on the input and output delimiters of opts
+func (opts Options) checkDelimiters() error {
+	if err := CheckDelimiter(opts.delimiter(), opts); err != nil {
+		return err
+	}
+	if opts.OutputDelimiter != "" {
+		if err := CheckDelimiter(opts.OutputDelimiter, opts); err != nil {
+			return fmt.Errorf("output %w", err)
+		}
+	}
+	return nil
+}
+
+// outputDelimiter returns the field separator of output lines, defaulting to the input one
+func (opts Options) outputDelimiter() string {
+	if opts.OutputDelimiter == "" {
+		return opts.delimiter()
+	}
+	return opts.OutputDelimiter
+}
+
+// joinTrailing returns the fields after the value with the output separator between them
+func (opts Options) joinTrailing(trailing string) string {
+	return strings.ReplaceAll(trailing, opts.delimiter(), opts.outputDelimiter())
+}
+
+// align returns the byte alignment of packed values, at least 1
+func (opts Options) align() int {
+	return max(opts.Align, 1)
+}
+
+// ignored reports whether line is dropped without conversion: a blank line under
+// TrimSpace, or an empty or comment line under CommentPrefix
+func (opts Options) ignored(line string) bool {
+	if opts.TrimSpace && strings.TrimSpace(line) == "" {
+		return true
+	}
+	return opts.CommentPrefix != "" && (line == "" || strings.HasPrefix(line, opts.CommentPrefix))
+}
+
+// lineEnding returns the output line terminator
+func (opts Options) lineEnding() string {
+	if opts.RecordSeparator != "" {
+		return opts.RecordSeparator
+	}
+	if opts.CRLF {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// Converts a single value field in the direction and format given by opts
+func convertValue(value string, opts Options) (string, error) {
+	if opts.Direction == Decompress {
+		bits, err := DecodeBits(value, opts)
+		if err != nil || opts.InverseTransform == nil {
+			return bits, err
+		}
+		return opts.InverseTransform(bits)
+	}
+	if opts.Transform != nil {
+		var err error
+		if value, err = opts.Transform(value); err != nil {
+			return "", err
+		}
+	}
+	return EncodeBits(value, opts)
+}
+
+// errIgnoredLine marks a line that is dropped without conversion, see Options.ignored
+var errIgnoredLine = errors.New("ignored line")
+
+// errLimitReached stops a conversion that has converted Options.Limit lines
+var errLimitReached = errors.New("line limit reached")
+
+// Converts one matrixSize:value line according to opts. Only the value field is
+// converted; any fields after it (following the checksum, when there is one) are
+// carried through unchanged.
+func convertLine(line string, opts Options) (string, error) {
+	if opts.ignored(line) {
+		return "", errIgnoredLine
+	}
+	if err := checkASCII(line); err != nil {
+		return "", err
+	}
+	if err := opts.checkDelimiters(); err != nil {
+		return "", err
+	}
+	delim := opts.delimiter()
+	matrixSize, value, found := strings.Cut(line, delim)
+	if !found {
+		return "", fmt.Errorf("%w %q: missing %q separator", ErrMalformedLine, line, delim)
+	}
+	value, trailing, hasTrailing := strings.Cut(value, delim)
+	if opts.TrimSpace {
+		opts.Direction = opts.Direction.resolve(strings.TrimSpace(value))
+	} else {
+		opts.Direction = opts.Direction.resolve(value)
+	}
+	var sum string
+	if opts.Checksum && opts.Direction == Decompress {
+		if !hasTrailing {
+			return "", fmt.Errorf("%w %q: missing checksum field", ErrMalformedLine, line)
+		}
+		sum, trailing, hasTrailing = strings.Cut(trailing, delim)
+	}
+	if opts.TrimSpace {
+		matrixSize, value, sum = strings.TrimSpace(matrixSize), strings.TrimSpace(value), strings.TrimSpace(sum)
+	}
+	if opts.ValidateSize && opts.Direction == Compress {
+		if err := checkMatrixSize(matrixSize, len(value)); err != nil {
+			return "", err
+		}
+	}
+	converted, err := convertValue(value, opts)
+	if err != nil {
+		return "", err
+	}
+	if opts.ValidateSize && opts.Direction == Decompress {
+		if err := checkMatrixSize(matrixSize, len(converted)); err != nil {
+			return "", err
+		}
+	}
+	if opts.SizeField != nil {
+		if matrixSize, err = opts.SizeField(matrixSize); err != nil {
+			return "", err
+		}
+	}
+	outDelim := opts.outputDelimiter()
+	out := matrixSize + outDelim + converted
+	if opts.Checksum {
+		if opts.Direction == Compress {
+			out += outDelim + bitsChecksum(value)
+		} else if want := bitsChecksum(converted); !strings.EqualFold(sum, want) {
+			return "", fmt.Errorf("checksum mismatch: line has %s, data has %s", sum, want)
+		}
+	}
+	if hasTrailing {
+		out += outDelim + opts.joinTrailing(trailing)
+	}
+	return out, nil
+}
+
+// streamMinLine is the line length from which serial decompression of hex values writes
+// the bits straight to the output instead of building the converted line in memory
+const streamMinLine = 1 << 16
+
+// streamable reports whether line is decompressed by streamLine: a long hex value
+// whose conversion needs none of the options that work on the whole line
+func streamable(line string, opts Options) bool {
+	if len(line) < streamMinLine || opts.Dedup || opts.Sample > 0 || opts.SortBySize || opts.InverseTransform != nil || opts.Checksum || opts.TrimSpace || opts.ignored(line) || (opts.Format != "" && opts.Format != FormatHex) {
+		return false
+	}
+	delim := opts.delimiter()
+	_, value, _ := strings.Cut(line, delim)
+	value, _, _ = strings.Cut(value, delim)
+	return opts.Direction.resolve(value) == Decompress
+}
+
+// streamLine decompresses a streamable line straight to w, along with the line ending.
+// A conversion error is returned as convErr before anything is written; writeErr reports
+// a failed write.
+func streamLine(w io.Writer, line string, opts Options) (n int, convErr, writeErr error) {
+	if err := checkASCII(line); err != nil {
+		return 0, err, nil
+	}
+	delim := opts.delimiter()
+	matrixSize, value, found := strings.Cut(line, delim)
+	if !found {
+		return 0, fmt.Errorf("%w %q: missing %q separator", ErrMalformedLine, line, delim), nil
+	}
+	value, trailing, hasTrailing := strings.Cut(value, delim)
+	encoded, bits, err := checkHexValue(value, opts.align())
+	if err != nil {
+		return 0, err, nil
+	}
+	if opts.ValidateSize {
+		if err := checkMatrixSize(matrixSize, bits); err != nil {
+			return 0, err, nil
+		}
+	}
+	if opts.SizeField != nil {
+		if matrixSize, err = opts.SizeField(matrixSize); err != nil {
+			return 0, err, nil
+		}
+	}
+	outDelim := opts.outputDelimiter()
+	n, err = io.WriteString(w, matrixSize+outDelim)
+	if err != nil {
+		return n, nil, err
+	}
+	m, err := writeHexBits(w, encoded, bits, opts.LSBFirst)
+	n += m
+	if err != nil {
+		return n, nil, err
+	}
+	end := opts.lineEnding()
+	if hasTrailing {
+		end = outDelim + opts.joinTrailing(trailing) + end
+	}
+	m, err = io.WriteString(w, end)
+	return n + m, nil, err
+}
+
+// Rejects a line holding non-ASCII bytes, which no field may contain and which
+// point to a mis-encoded input file
+func checkASCII(line string) error {
+	for i := 0; i < len(line); i++ {
+		if line[i] >= utf8.RuneSelf {
+			return fmt.Errorf("%w: non-ASCII byte 0x%02X at index %d: input is not plain ASCII text", ErrMalformedLine, line[i], i)
+		}
+	}
+	return nil
+}
+
+// SquareSize is an Options.SizeField function that spells a square size "N" as "NxN",
+// leaving "RxC" sizes as they are
+func SquareSize(matrixSize string) (string, error) {
+	if strings.Contains(matrixSize, "x") {
+		return matrixSize, nil
+	}
+	if _, err := strconv.Atoi(matrixSize); err != nil {
+		return "", fmt.Errorf("invalid matrix size %q", matrixSize)
+	}
+	return matrixSize + "x" + matrixSize, nil
+}
+
+// Returns the number of bits a matrix of the given size holds: N*N for a
+// square size "N", or R*C for "RxC"
+func matrixBits(matrixSize string) (int, error) {
+	rows, cols, found := strings.Cut(matrixSize, "x")
+	if !found {
+		cols = rows
+	}
+	r, errR := strconv.Atoi(rows)
+	c, errC := strconv.Atoi(cols)
+	if errR != nil || errC != nil || r < 0 || c < 0 {
+		return 0, fmt.Errorf("invalid matrix size %q", matrixSize)
+	}
+	return r * c, nil
+}
+
+// Checks that a value of bitCount bits fits the declared matrix size
+func checkMatrixSize(matrixSize string, bitCount int) error {
+	want, err := matrixBits(matrixSize)
+	if err != nil {
+		return err
+	}
+	if bitCount != want {
+		return fmt.Errorf("matrix size %s expects %d bits, got %d", matrixSize, want, bitCount)
+	}
+	return nil
+}
+
+// Computes the CRC32 of the packed form of a binary string as 8 hex digits
+func bitsChecksum(binStr string) string {
+	return fmt.Sprintf("%08X", crc32.ChecksumIEEE(packBits(binStr, false)))
+}
+
+// Stdio is the file name that stands for stdin or stdout
+const Stdio = "-"
+
+// nopWriteCloser lets stdout be used as an output without being closed
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// gzipExt marks input and output files that are transparently gzip-compressed
+const gzipExt = ".gz"
+
+// gzipReadCloser closes both the decompressor and the underlying file
+type gzipReadCloser struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r gzipReadCloser) Close() error {
+	return errors.Join(r.Reader.Close(), r.file.Close())
+}
+
+// gzipWriteCloser flushes the compressor before closing the underlying file
+type gzipWriteCloser struct {
+	*gzip.Writer
+	file io.Closer
+}
+
+func (w gzipWriteCloser) Close() error {
+	return errors.Join(w.Writer.Close(), w.file.Close())
+}
+
+// syncedFile flushes the file to stable storage before closing it
+type syncedFile struct {
+	*os.File
+}
+
+func (f syncedFile) Close() error {
+	return errors.Join(f.Sync(), f.File.Close())
+}
+
+// Opens inputFile for reading, or stdin when it is "-". Files ending in
+// ".gz" are decompressed as they are read.
+func openInput(inputFile string) (io.ReadCloser, error) {
+	if inputFile == Stdio {
+		return io.NopCloser(os.Stdin), nil
+	}
+	f, err := os.Open(inputFile)
+	if err != nil || !strings.HasSuffix(inputFile, gzipExt) {
+		return f, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", inputFile, err)
+	}
+	return gzipReadCloser{gz, f}, nil
+}
+
+// Opens outputFile for writing with os.O_TRUNC, os.O_EXCL or os.O_APPEND, or returns
+// stdout when it is "-". Files ending in ".gz" are gzip-compressed, appending a new
+// gzip member. With os.O_EXCL an existing file is left untouched and an error
+// wrapping fs.ErrExist is returned. With sync, closing the file first syncs it to disk.
+func openOutput(outputFile string, mode int, sync bool) (io.WriteCloser, error) {
+	if outputFile == Stdio {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	f, err := os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE|mode, 0o666)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, existsError(outputFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return wrapOutput(f, outputFile, sync), nil
+}
+
+// Reports that outputFile is in the way of a no-clobber write
+func existsError(outputFile string) error {
+	return fmt.Errorf("output %s already exists: %w", outputFile, fs.ErrExist)
+}
+
+// Wraps f in a gzip compressor when the output name ends in ".gz", and makes
+// closing it sync the file first when sync is set
+func wrapOutput(f *os.File, outputFile string, sync bool) io.WriteCloser {
+	var out io.WriteCloser = f
+	if sync {
+		out = syncedFile{f}
+	}
+	if !strings.HasSuffix(outputFile, gzipExt) {
+		return out
+	}
+	return gzipWriteCloser{gzip.NewWriter(out), out}
+}
+
+// Converts line, consulting and filling cache unless it is nil. A non-empty scope is
+// appended to the cache key, after a newline, to keep apart the entries of lines
+// converted with different options.
+func convertCachedLine(line, scope string, cache *Cache[string], opts Options) (string, error) {
+	if cache == nil || opts.ignored(line) {
+		return convertLine(line, opts)
+	}
+	key := line
+	if scope != "" {
+		key += "\n" + scope
+	}
+	return cache.GetOrSet(key, func() (string, error) { return convertLine(line, opts) })
+}
+
+// ConvertLine converts a single matrixSize:value line, looking it up in and storing it
+// to cache unless it is nil. A line ignored by TrimSpace or CommentPrefix converts to "",
+// or to itself with KeepComments.
+func ConvertLine(line string, cache *Cache[string], opts Options) (string, error) {
+	converted, err := convertCachedLine(line, "", cache, opts)
+	if err == errIgnoredLine {
+		if opts.KeepComments {
+			return line, nil
+		}
+		return "", nil
+	}
+	return converted, err
+}
+
+// Errors reported for the content of a line, for use with errors.Is. The conversions of
+// streams, files and lists of lines wrap them in a *LineError, which holds the number and
+// content of the line; I/O errors are returned as they are and match none of these.
+var (
+	// ErrMalformedLine reports a line whose fields cannot be split, such as one without
+	// the delimiter, or that holds non-ASCII bytes
+	ErrMalformedLine = errors.New("malformed line")
+	// ErrInvalidBinary reports a binary value holding characters other than 0 and 1
+	ErrInvalidBinary = errors.New("invalid binary")
+	// ErrInvalidHex reports a hex value with non-hex digits or a partial byte
+	ErrInvalidHex = errors.New("invalid hex")
+)
+
+// LineError reports a line that failed to convert, with its 1-based number, content
+// and the byte offset of its start in the input. Offset is -1 for lines that were not
+// read from an input stream.
+type LineError struct {
+	Line    int
+	Offset  int64
+	Content string
+	Err     error
+}
+
+func (e *LineError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d (byte %d): %v", e.Line, e.Offset, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// LineResult is the outcome of converting one line with ConvertLines
+type LineResult struct {
+	Input  string
+	Output string
+	Err    error
+}
+
+// ConvertLines converts each of lines in memory, returning one result per input line in
+// the same order. Lines are looked up in and stored to cache unless it is nil. The error
+// is that of the first line that failed, if any; blank lines dropped by TrimSpace have an
+// empty Output and no error.
+func ConvertLines(lines []string, cache *Cache[string], opts Options) ([]LineResult, error) {
+	results := make([]LineResult, len(lines))
+	var firstErr error
+	for i, line := range lines {
+		output, err := ConvertLine(line, cache, opts)
+		if err != nil && firstErr == nil {
+			firstErr = &LineError{Line: i + 1, Offset: -1, Content: line, Err: err}
+		}
+		results[i] = LineResult{Input: line, Output: output, Err: err}
+	}
+	return results, firstErr
+}
+
+// warmPairSep separates an input line from its converted form in a warm file
+const warmPairSep = " -> "
+
+// WarmCache preloads cache from r, which holds either "input -> converted" pairs or
+// plain input lines that are converted as opts describes. Entries are stored in file
+// order, so the cache bound keeps the last ones. It returns the number of lines stored.
+func WarmCache(cache *Cache[string], r io.Reader, opts Options) (int, error) {
+	scanner := newScanner(r, opts)
+	offsets := lineOffsets{inner: opts.Split}
+	scanner.Split(offsets.split)
+	lineNum, stored := 0, 0
+	for scanner.Scan() {
+		lineNum++
+		line, converted, paired := strings.Cut(scanner.Text(), warmPairSep)
+		if !paired {
+			var err error
+			if converted, err = convertLine(line, opts); err == errIgnoredLine {
+				continue
+			} else if err != nil {
+				return stored, &LineError{Line: lineNum, Offset: offsets.start, Content: line, Err: err}
+			}
+		}
+		cache.Set(line, converted)
+		stored++
+	}
+	if err := scanner.Err(); err != nil {
+		return stored, scanError(err, opts)
+	}
+	return stored, nil
+}
+
+// WarmCacheFile runs WarmCache over the file at path
+func WarmCacheFile(cache *Cache[string], path string, opts Options) (int, error) {
+	input, err := openInput(path)
+	if err != nil {
+		return 0, err
+	}
+	defer input.Close()
+	return WarmCache(cache, input, opts)
+}
+
+// lineOffsets tracks where in the input each line returned by a scanner starts. inner
+// is the split function finding the lines, bufio.ScanLines when nil.
+type lineOffsets struct {
+	inner bufio.SplitFunc
+	start int64
+	end   int64
+}
+
+// split is the inner split function, recording the offset of each line as it is returned.
+// Offsets count the line endings, including any "\r" that ScanLines drops.
+func (o *lineOffsets) split(data []byte, atEOF bool) (int, []byte, error) {
+	inner := o.inner
+	if inner == nil {
+		inner = bufio.ScanLines
+	}
+	advance, token, err := inner(data, atEOF)
+	if token != nil {
+		o.start = o.end
+	}
+	o.end += int64(advance)
+	return advance, token, err
+}
+
+// Returns a scanner over the lines of r, split by opts.Split when it is set, that accepts
+// lines up to opts.MaxLineSize
+func newScanner(r io.Reader, opts Options) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	if opts.MaxLineSize > 0 {
+		scanner.Buffer(make([]byte, 0, min(opts.MaxLineSize, bufio.MaxScanTokenSize)), opts.MaxLineSize)
+	}
+	if opts.Split != nil {
+		scanner.Split(opts.Split)
+	}
+	return scanner
+}
+
+// ScanNull is a bufio.SplitFunc for Options.Split that splits records at NUL bytes,
+// returning a final record that has no NUL after it
+func ScanNull(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Explains a scanner failure, naming the limit when a line was too long
+func scanError(err error, opts Options) error {
+	if !errors.Is(err, bufio.ErrTooLong) {
+		return err
+	}
+	limit := opts.MaxLineSize
+	if limit <= 0 {
+		limit = bufio.MaxScanTokenSize
+	}
+	return fmt.Errorf("input line longer than the %d byte limit: %w", limit, err)
+}
+
+// Summary counts the lines handled by a conversion. FailedFiles is only
+// set by ConvertFiles. InputBytes and OutputBytes count the uncompressed
+// bytes read and written, including line endings. Uncached counts the inputs
+// that Options.AutoCache stopped caching, and Duplicates the converted lines that
+// Options.Dedup dropped; they are not counted in Lines.
+type Summary struct {
+	Lines       int
+	Errors      int
+	FailedFiles int
+	InputBytes  int64
+	OutputBytes int64
+	Uncached    int
+	Duplicates  int
+}
+
+// Ratio returns OutputBytes/InputBytes, or 0 when nothing was read
+func (s Summary) Ratio() float64 {
+	if s.InputBytes == 0 {
+		return 0
+	}
+	return float64(s.OutputBytes) / float64(s.InputBytes)
+}
+
+// add accumulates another summary into s
+func (s *Summary) add(other Summary) {
+	s.Lines += other.Lines
+	s.Errors += other.Errors
+	s.FailedFiles += other.FailedFiles
+	s.InputBytes += other.InputBytes
+	s.OutputBytes += other.OutputBytes
+	s.Uncached += other.Uncached
+	s.Duplicates += other.Duplicates
+}
+
+// autoCacheMinRepeats is the share of sampled lines that must repeat an earlier one
+// for Options.AutoCache to keep caching
+const autoCacheMinRepeats = 0.05
+
+// cacheSample tracks how many of the first lines of an input repeat an earlier one
+type cacheSample struct {
+	seen    map[string]bool
+	lines   int
+	repeats int
+	limit   int
+}
+
+// add records line and reports whether the sample is complete
+func (s *cacheSample) add(line string) bool {
+	if s.seen[line] {
+		s.repeats++
+	} else {
+		s.seen[line] = true
+	}
+	s.lines++
+	return s.lines >= s.limit
+}
+
+// worthwhile reports whether enough sampled lines repeated to keep caching
+func (s *cacheSample) worthwhile() bool {
+	return float64(s.repeats) >= autoCacheMinRepeats*float64(s.lines)
+}
+
+// countingReader counts the bytes read through it into *n
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// followInterval is how often Options.Follow polls for data appended to the input
+const followInterval = 250 * time.Millisecond
+
+// followReader turns the end of r into a wait for more data for Options.Follow. idle is
+// called before each wait, and reading fails with ctx.Err() once ctx is canceled.
+type followReader struct {
+	r    io.Reader
+	ctx  context.Context
+	idle func() error
+}
+
+func (f *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.r.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if err := f.idle(); err != nil {
+			return 0, err
+		}
+		select {
+		case <-f.ctx.Done():
+			return 0, f.ctx.Err()
+		case <-time.After(followInterval):
+		}
+	}
+}
+
+// countingWriter counts the bytes written through it into *n
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// Convert converts matrixSize:value lines from r to w according to opts.
+// Converted lines are looked up in and stored to cache unless it is nil.
+func Convert(r io.Reader, w io.Writer, cache *Cache[string], opts Options) (Summary, error) {
+	return ConvertContext(context.Background(), r, w, cache, opts)
+}
+
+// cancelCheckInterval is how many lines are converted between context checks
+const cancelCheckInterval = 256
+
+// progressInterval is how many lines are converted between Options.Progress calls
+const progressInterval = 1 << 14
+
+// ConvertContext is like Convert, but stops with ctx.Err() once ctx is canceled. Lines converted
+// before the cancellation are flushed to w. Without LineWorkers, hex values of lines of
+// streamMinLine bytes or more are decompressed straight to w, bypassing the cache. With
+// Format FormatRaw the output (or, decompressing, the input) is a raw file instead of text.
+func ConvertContext(ctx context.Context, r io.Reader, w io.Writer, cache *Cache[string], opts Options) (Summary, error) {
+	if opts.Format == FormatRaw {
+		return convertRaw(ctx, r, w, opts)
+	}
+	var summary Summary
+	r = countingReader{r, &summary.InputBytes}
+	writer := bufio.NewWriter(w)
+	if opts.BufferSize > 0 {
+		writer = bufio.NewWriterSize(w, opts.BufferSize)
+	}
+	if opts.Follow {
+		r = &followReader{r: r, ctx: ctx, idle: writer.Flush}
+	}
+	headerLines := 0
+	// scope holds the header line, which changes how the lines after it convert, so that
+	// a cache shared between inputs does not mix up their results
+	scope := ""
+	offsets := lineOffsets{inner: opts.Split}
+	if opts.Direction != Compress {
+		reader := bufio.NewReader(r)
+		// Comments may start with headerPrefix too, so only a full header field counts then
+		want := headerPrefix
+		if opts.CommentPrefix != "" {
+			want = headerPrefix + "format" + headerValueSep
+		}
+		if prefix, err := reader.Peek(len(want)); err == nil && string(prefix) == want {
+			end := opts.lineEnding()
+			header, err := reader.ReadString(end[len(end)-1])
+			if err != nil && err != io.EOF {
+				return summary, err
+			}
+			scope = strings.TrimRight(header, "\r\n"+end)
+			if opts, err = applyHeader(scope, opts); err != nil {
+				return summary, fmt.Errorf("line 1: %w", err)
+			}
+			headerLines = 1
+			offsets.end = int64(len(header))
+		}
+		r = reader
+	}
+	if err := opts.checkDelimiters(); err != nil {
+		return summary, err
+	}
+	scanner := newScanner(r, opts)
+	scanner.Split(offsets.split)
+	lineEnding := opts.lineEnding()
+	if opts.Header && opts.Direction == Compress {
+		n, _ := writer.WriteString(formatHeader(opts) + lineEnding)
+		summary.OutputBytes += int64(n)
+	}
+	if opts.Progress != nil {
+		defer func() { opts.Progress(summary.Lines % progressInterval) }()
+	}
+	skipped := 0
+	for skipped < opts.SkipLines && scanner.Scan() {
+		skipped++
+	}
+	lineOffset := headerLines + skipped
+	var sample *cacheSample
+	if opts.AutoCache > 0 && cache != nil {
+		sample = &cacheSample{seen: make(map[string]bool), limit: opts.AutoCache}
+	}
+	var seen map[string]struct{}
+	if opts.Dedup {
+		seen = make(map[string]struct{})
+	}
+	var picked *reservoir
+	if opts.Sample > 0 {
+		picked = newReservoir(opts.Sample, opts.Seed)
+	}
+	// held collects the converted lines for SortBySize
+	var held []string
+	// convert reads cache when it is called, so it sees the sample's decision
+	convert := func(line string) (string, error) {
+		return convertCachedLine(line, scope, cache, opts)
+	}
+
+	// written counts a converted line of which n bytes were written
+	written := func(n int, err error) error {
+		summary.Lines++
+		if opts.Progress != nil && summary.Lines%progressInterval == 0 {
+			opts.Progress(progressInterval)
+		}
+		summary.OutputBytes += int64(n)
+		if err == nil && summary.Lines == opts.Limit {
+			err = errLimitReached
+		}
+		return err
+	}
+
+	// emit writes the result of converting line number num, which starts at byte offset;
+	// results arrive in input order
+	emit := func(num int, offset int64, line, newLine string, err error) error {
+		if sample != nil && sample.add(line) {
+			if !sample.worthwhile() {
+				cache = nil
+				summary.Uncached++
+			}
+			sample = nil
+		}
+		if err == errIgnoredLine {
+			if opts.KeepComments {
+				n, err := writer.WriteString(line + lineEnding)
+				summary.OutputBytes += int64(n)
+				return err
+			}
+			return nil
+		}
+		if err != nil {
+			summary.Errors++
+			err = &LineError{Line: lineOffset + num, Offset: offset, Content: line, Err: err}
+			if !opts.SkipErrors {
+				return err
+			}
+			if opts.OnSkip != nil {
+				opts.OnSkip(err)
+			}
+			return nil
+		}
+		if seen != nil {
+			if _, dup := seen[newLine]; dup {
+				summary.Duplicates++
+				return nil
+			}
+			seen[newLine] = struct{}{}
+		}
+		if picked != nil {
+			picked.add(newLine)
+			return nil
+		}
+		if opts.SortBySize {
+			held = append(held, newLine)
+			return nil
+		}
+		return written(writer.WriteString(newLine + lineEnding))
+	}
+
+	var err error
+	if opts.LineWorkers > 1 && !opts.Follow {
+		err = convertParallel(ctx, scanner, &offsets, convert, opts, emit)
+	} else {
+		lineNum := 0
+		for err == nil {
+			if lineNum%cancelCheckInterval == 0 {
+				if err = ctx.Err(); err != nil {
+					break
+				}
+			}
+			if !scanner.Scan() {
+				break
+			}
+			lineNum++
+			line := scanner.Text()
+			if streamable(line, opts) {
+				n, convErr, writeErr := streamLine(writer, line, opts)
+				if convErr != nil {
+					err = emit(lineNum, offsets.start, line, "", convErr)
+				} else {
+					err = written(n, writeErr)
+				}
+				continue
+			}
+			newLine, convErr := convert(line)
+			err = emit(lineNum, offsets.start, line, newLine, convErr)
+		}
+	}
+	if err == errLimitReached {
+		return summary, writer.Flush()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			writer.Flush()
+		}
+		return summary, err
+	}
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			writer.Flush()
+		}
+		return summary, scanError(err, opts)
+	}
+	if picked != nil {
+		held = picked.lines()
+	}
+	if opts.SortBySize {
+		sortBySize(held, opts.outputDelimiter())
+	}
+	for _, line := range held {
+		if err := written(writer.WriteString(line + lineEnding)); err == errLimitReached {
+			break
+		} else if err != nil {
+			return summary, err
+		}
+	}
+	return summary, writer.Flush()
+}
+
+// Stably sorts converted lines by the bit count of their size field, the text before
+// delim, putting sizes that do not parse last
+func sortBySize(lines []string, delim string) {
+	type keyed struct {
+		bits int
+		line string
+	}
+	keys := make([]keyed, len(lines))
+	for i, line := range lines {
+		matrixSize, _, _ := strings.Cut(line, delim)
+		bits, err := matrixBits(matrixSize)
+		if err != nil {
+			bits = math.MaxInt
+		}
+		keys[i] = keyed{bits, line}
+	}
+	slices.SortStableFunc(keys, func(a, b keyed) int { return cmp.Compare(a.bits, b.bits) })
+	for i, k := range keys {
+		lines[i] = k.line
+	}
+}
+
+// reservoir keeps a uniform random sample of the lines added to it, using Algorithm R
+type reservoir struct {
+	rng    *rand.Rand
+	size   int
+	added  int
+	sample []sampledLine
+}
+
+// sampledLine is a line of a reservoir with its position among the added lines
+type sampledLine struct {
+	index int
+	line  string
+}
+
+// newReservoir returns an empty reservoir of size lines whose choices are seeded by seed
+func newReservoir(size int, seed int64) *reservoir {
+	return &reservoir{rng: rand.New(rand.NewSource(seed)), size: size}
+}
+
+// add offers line to the sample, replacing a random earlier pick once the sample is full
+func (r *reservoir) add(line string) {
+	r.added++
+	if len(r.sample) < r.size {
+		r.sample = append(r.sample, sampledLine{r.added - 1, line})
+		return
+	}
+	if j := r.rng.Intn(r.added); j < len(r.sample) {
+		r.sample[j] = sampledLine{r.added - 1, line}
+	}
+}
+
+// lines returns the sampled lines in the order they were added
+func (r *reservoir) lines() []string {
+	slices.SortFunc(r.sample, func(a, b sampledLine) int { return a.index - b.index })
+	lines := make([]string, len(r.sample))
+	for i, s := range r.sample {
+		lines[i] = s.line
+	}
+	return lines
+}
+
+// parallelBatchSize is the number of lines read before fanning them out to workers
+const parallelBatchSize = 4096
+
+// Converts the scanned lines in batches spread over opts.LineWorkers goroutines,
+// passing the results of convert to emit in their original order. offsets is the scanner's
+// split state.
+func convertParallel(ctx context.Context, scanner *bufio.Scanner, offsets *lineOffsets, convert func(string) (string, error), opts Options, emit func(int, int64, string, string, error) error) error {
+	lines := make([]string, 0, parallelBatchSize)
+	starts := make([]int64, 0, parallelBatchSize)
+	results := make([]string, parallelBatchSize)
+	errs := make([]error, parallelBatchSize)
+	lineNum := 0
+
+	flush := func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var wg sync.WaitGroup
+		chunk := (len(lines) + opts.LineWorkers - 1) / opts.LineWorkers
+		for start := 0; start < len(lines); start += chunk {
+			end := min(start+chunk, len(lines))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := start; i < end; i++ {
+					results[i], errs[i] = convert(lines[i])
+				}
+			}()
+		}
+		wg.Wait()
+		for i := range lines {
+			lineNum++
+			if err := emit(lineNum, starts[i], lines[i], results[i], errs[i]); err != nil {
+				return err
+			}
+		}
+		lines, starts = lines[:0], starts[:0]
+		return nil
+	}
+
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		starts = append(starts, offsets.start)
+		if len(lines)%cancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if len(lines) == parallelBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// ConvertFile converts inputFile to outputFile, passing a nil cache to disable caching.
+// Either name may be "-" for stdin or stdout; names ending in ".gz" are gzip-compressed.
+func ConvertFile(inputFile, outputFile string, cache *Cache[string], opts Options) (Summary, error) {
+	return ConvertFileContext(context.Background(), inputFile, outputFile, cache, opts)
+}
+
+// ConvertFileContext is like ConvertFile, but stops once ctx is canceled, leaving the lines
+// converted so far in outputFile unless opts.Atomic is set
+func ConvertFileContext(ctx context.Context, inputFile, outputFile string, cache *Cache[string], opts Options) (Summary, error) {
+	input, err := openInput(inputFile)
+	if err != nil {
+		return Summary{}, err
+	}
+	defer input.Close()
+
+	mode := os.O_TRUNC
+	if opts.NoClobber {
+		mode = os.O_EXCL
+	}
+	if opts.SplitLines > 0 && (opts.Resume || outputFile == Stdio) {
+		return Summary{}, errors.New("SplitLines cannot be combined with Resume or a stdout output")
+	}
+	if opts.Split != nil && (opts.Resume || opts.SplitLines > 0) {
+		return Summary{}, errors.New("Split cannot be combined with Resume or SplitLines")
+	}
+	if opts.Resume && outputFile != Stdio {
+		if opts.SkipErrors || opts.TrimSpace || opts.Dedup || opts.CommentPrefix != "" || opts.Sample > 0 || opts.SortBySize {
+			return Summary{}, errors.New("resume cannot be combined with SkipErrors, TrimSpace, Dedup, CommentPrefix, Sample or SortBySize")
+		}
+		done, err := countLines(outputFile)
+		if err != nil {
+			return Summary{}, err
+		}
+		// The header was written by the interrupted run
+		if opts.Header && opts.Direction == Compress && done > 0 {
+			done--
+			opts.Header = false
+		}
+		opts.SkipLines += done
+		mode = os.O_APPEND
+	} else if opts.Atomic && outputFile != Stdio && !opts.DryRun && opts.SplitLines <= 0 && !opts.Follow {
+		return convertAtomic(ctx, input, outputFile, cache, opts)
+	}
+
+	var output io.WriteCloser = nopWriteCloser{io.Discard}
+	switch {
+	case opts.DryRun:
+	case opts.SplitLines > 0:
+		// Every chunk gets the header, so the splitter writes it instead
+		header := ""
+		if opts.Header && opts.Direction == Compress {
+			header, opts.Header = formatHeader(opts)+opts.lineEnding(), false
+		}
+		output, err = newSplitWriter(outputFile, mode, opts.SplitLines, header, opts.Sync)
+	default:
+		output, err = openOutput(outputFile, mode, opts.Sync)
+	}
+	if err != nil {
+		return Summary{}, err
+	}
+
+	// Closing finishes a gzip stream, so its error matters
+	summary, err := ConvertContext(ctx, input, output, cache, opts)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	return summary, err
+}
+
+// splitWriter spreads the lines written to it over chunk files of at most limit
+// lines each, opening the next chunk only once a line arrives for it
+type splitWriter struct {
+	name   string
+	mode   int
+	limit  int
+	header string
+	sync   bool
+	chunk  int
+	lines  int
+	out    io.WriteCloser
+}
+
+// Opens the first chunk of outputFile, so that even an empty conversion leaves one
+func newSplitWriter(outputFile string, mode, limit int, header string, sync bool) (*splitWriter, error) {
+	w := &splitWriter{name: outputFile, mode: mode, limit: limit, header: header, sync: sync}
+	return w, w.next()
+}
+
+// chunkName returns the name of chunk i of outputFile, keeping a ".gz" suffix last
+func chunkName(outputFile string, i int) string {
+	base, gz := strings.CutSuffix(outputFile, gzipExt)
+	name := fmt.Sprintf("%s.%03d", base, i)
+	if gz {
+		name += gzipExt
+	}
+	return name
+}
+
+// next closes the current chunk and opens the following one
+func (w *splitWriter) next() error {
+	if w.out != nil {
+		err := w.out.Close()
+		w.out = nil
+		if err != nil {
+			return err
+		}
+	}
+	out, err := openOutput(chunkName(w.name, w.chunk), w.mode, w.sync)
+	if err != nil {
+		return err
+	}
+	w.out = out
+	w.chunk++
+	w.lines = 0
+	_, err = io.WriteString(out, w.header)
+	return err
+}
+
+func (w *splitWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.lines == w.limit {
+			if err := w.next(); err != nil {
+				return written, err
+			}
+		}
+		// Write up to the end of the line that fills the current chunk
+		end, lines := len(p), 0
+		for i, b := range p {
+			if b == '\n' {
+				lines++
+				if w.lines+lines == w.limit {
+					end = i + 1
+					break
+				}
+			}
+		}
+		n, err := w.out.Write(p[:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		w.lines += lines
+		p = p[end:]
+	}
+	return written, nil
+}
+
+func (w *splitWriter) Close() error {
+	if w.out == nil {
+		return nil
+	}
+	return w.out.Close()
+}
+
+// Converts input into a temporary file next to outputFile and renames it over
+// outputFile once the conversion succeeds; on failure the temporary file is removed
+func convertAtomic(ctx context.Context, input io.Reader, outputFile string, cache *Cache[string], opts Options) (Summary, error) {
+	perm := fs.FileMode(0o644)
+	if info, err := os.Stat(outputFile); err == nil {
+		if opts.NoClobber {
+			return Summary{}, existsError(outputFile)
+		}
+		perm = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(outputFile), "."+filepath.Base(outputFile)+".tmp*")
+	if err != nil {
+		return Summary{}, err
+	}
+	output := wrapOutput(tmp, outputFile, opts.Sync)
+	summary, err := ConvertContext(ctx, input, output, cache, opts)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), outputFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	} else if opts.Sync {
+		err = syncDir(filepath.Dir(outputFile))
+	}
+	return summary, err
+}
+
+// Syncs the directory at path so that a rename within it is durable
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return errors.Join(dir.Sync(), dir.Close())
+}
+
+// Counts the complete lines of an output file being resumed; a missing file has
+// none, and a file that ends mid-line cannot be resumed
+func countLines(path string) (int, error) {
+	f, err := openInput(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	lines := 0
+	last := byte('\n')
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			lines += bytes.Count(buf[:n], []byte{'\n'})
+			last = buf[n-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if last != '\n' {
+		return 0, fmt.Errorf("%s ends mid-line after %d lines; cannot resume", path, lines)
+	}
+	return lines, nil
+}
+
+// ConvertWithCache converts mat.in to mat.in.x (or back, when decompressing) using caching
+func ConvertWithCache(inputFile, outputFile string, cache *Cache[string], opts Options) (Summary, error) {
+	return ConvertFile(inputFile, outputFile, cache, opts)
+}
+
+// ConvertWithoutCache converts mat.in to mat.in.x (or back, when decompressing) without caching
+func ConvertWithoutCache(inputFile, outputFile string, opts Options) (Summary, error) {
+	return ConvertFile(inputFile, outputFile, nil, opts)
+}
+
+// FileJob is one input/output pair of a batch conversion
+type FileJob struct {
+	InputFile  string
+	OutputFile string
+}
+
+// ConvertFiles converts every job using a pool of workers. Each worker gets its own cache
+// from newCache, or converts without caching when newCache is nil. A failing job does
+// not stop the others; its error is joined into the result.
+func ConvertFiles(jobs []FileJob, workers int, newCache func() *Cache[string], opts Options) (Summary, error) {
+	return ConvertFilesContext(context.Background(), jobs, workers, newCache, opts)
+}
+
+// ConvertFilesContext is like ConvertFiles, but once ctx is canceled the running jobs
+// stop as ConvertFileContext does and the remaining ones are not started
+func ConvertFilesContext(ctx context.Context, jobs []FileJob, workers int, newCache func() *Cache[string], opts Options) (Summary, error) {
+	pending := make(chan int)
+	errs := make([]error, len(jobs))
+	summaries := make([]Summary, len(jobs))
+
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, len(jobs)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var cache *Cache[string]
+			if newCache != nil {
+				cache = newCache()
+			}
+			for i := range pending {
+				job := jobs[i]
+				jobOpts := opts
+				if opts.OnSkip != nil {
+					jobOpts.OnSkip = func(err error) { opts.OnSkip(fmt.Errorf("%s: %w", job.InputFile, err)) }
+				}
+				summary, err := ConvertFileContext(ctx, job.InputFile, job.OutputFile, cache, jobOpts)
+				if err != nil {
+					errs[i] = fmt.Errorf("%s: %w", job.InputFile, err)
+					summary.FailedFiles = 1
+				}
+				summaries[i] = summary
+			}
+		}()
+	}
+	dispatched := 0
+	for dispatched < len(jobs) && ctx.Err() == nil {
+		select {
+		case pending <- dispatched:
+			dispatched++
+		case <-ctx.Done():
+		}
+	}
+	close(pending)
+	wg.Wait()
+	if dispatched < len(jobs) {
+		errs = append(errs, ctx.Err())
+	}
+
+	var total Summary
+	for _, summary := range summaries {
+		total.add(summary)
+	}
+	return total, errors.Join(errs...)
+}
+
+// Verify round-trips every line read from r through BinToHex and HexToBin without
+// writing output, returning the number of lines checked and how many failed to match
+func Verify(r io.Reader, opts Options) (lines, mismatches int, err error) {
+	scanner := newScanner(r, opts)
+	// Decompression reads the compressed delimiter and restores the original one
+	back := opts
+	back.Direction = Decompress
+	back.Delimiter, back.OutputDelimiter = opts.outputDelimiter(), opts.delimiter()
+	opts.Direction = Compress
+	for scanner.Scan() {
+		line := scanner.Text()
+		compressed, err := convertLine(line, opts)
+		if err == errIgnoredLine {
+			continue
+		}
+		lines++
+		if err != nil {
+			mismatches++
+			continue
+		}
+		restored, err := convertLine(compressed, back)
+		if err != nil || restored != line {
+			mismatches++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return lines, mismatches, scanError(err, opts)
+	}
+	return lines, mismatches, nil
+}
+
+// VerifyFile runs Verify over inputFile, which may be "-" for stdin
+func VerifyFile(inputFile string, opts Options) (lines, mismatches int, err error) {
+	input, err := openInput(inputFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer input.Close()
+	return Verify(input, opts)
+}
+
+// Counts holds aggregate statistics of an input file gathered by Count. SetBits
+// maps a number of 1 bits to how many valid lines have that many.
+type Counts struct {
+	Lines     int         `json:"lines"`
+	Malformed int         `json:"malformed"`
+	Sizes     int         `json:"distinct_sizes"`
+	MinBits   int         `json:"min_bits"`
+	MaxBits   int         `json:"max_bits"`
+	AvgBits   float64     `json:"avg_bits"`
+	SetBits   map[int]int `json:"set_bits"`
+}
+
+// Bucket is one range of set-bit counts in a histogram, from Low to High inclusive
+type Bucket struct {
+	Low   int `json:"low"`
+	High  int `json:"high"`
+	Lines int `json:"lines"`
+}
+
+// Histogram groups SetBits into buckets of width set-bit counts starting at 0, up to
+// the bucket holding the largest count. Empty buckets in between are included.
+func (c Counts) Histogram(width int) []Bucket {
+	width = max(width, 1)
+	var buckets []Bucket
+	for bits, lines := range c.SetBits {
+		i := bits / width
+		for len(buckets) <= i {
+			low := len(buckets) * width
+			buckets = append(buckets, Bucket{Low: low, High: low + width - 1})
+		}
+		buckets[i].Lines += lines
+	}
+	return buckets
+}
+
+// Count scans matrixSize:binary lines from r without converting them. Lines without
+// a separator or with a non-binary value are counted as malformed and left out of
+// the other statistics.
+func Count(r io.Reader, opts Options) (Counts, error) {
+	counts := Counts{SetBits: make(map[int]int)}
+	sizes := make(map[string]bool)
+	valid, totalBits := 0, 0
+	delim := opts.delimiter()
+	scanner := newScanner(r, opts)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if opts.ignored(line) {
+			continue
+		}
+		counts.Lines++
+		matrixSize, value, found := strings.Cut(line, delim)
+		value, _, _ = strings.Cut(value, delim)
+		if opts.TrimSpace {
+			matrixSize, value = strings.TrimSpace(matrixSize), strings.TrimSpace(value)
+		}
+		if !found || validateBits(value) != nil {
+			counts.Malformed++
+			continue
+		}
+		sizes[matrixSize] = true
+		valid++
+		bits := len(value)
+		if valid == 1 || bits < counts.MinBits {
+			counts.MinBits = bits
+		}
+		counts.MaxBits = max(counts.MaxBits, bits)
+		totalBits += bits
+		counts.SetBits[strings.Count(value, "1")]++
+	}
+	if err := scanner.Err(); err != nil {
+		return counts, scanError(err, opts)
+	}
+	counts.Sizes = len(sizes)
+	if valid > 0 {
+		counts.AvgBits = float64(totalBits) / float64(valid)
+	}
+	return counts, nil
+}
+
+// CountFile runs Count over inputFile, which may be "-" for stdin
+func CountFile(inputFile string, opts Options) (Counts, error) {
+	input, err := openInput(inputFile)
+	if err != nil {
+		return Counts{}, err
+	}
+	defer input.Close()
+	return Count(input, opts)
+}
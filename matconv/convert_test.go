@@ -0,0 +1,1096 @@
+package matconv
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// convertString runs Convert over in and returns the output and summary
+func convertString(in string, cache *Cache[string], opts Options) (string, Summary, error) {
+	var out strings.Builder
+	summary, err := Convert(strings.NewReader(in), &out, cache, opts)
+	return out.String(), summary, err
+}
+
+// writeFile creates a file of dir holding data and returns its path
+func writeFile(t *testing.T, dir, name, data string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readOutput returns the contents of an output file, decompressing ".gz" files
+func readOutput(t *testing.T, path string) string {
+	t.Helper()
+	f, err := openInput(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// lineError returns the *LineError in the chain of err, failing the test without one
+func lineError(t *testing.T, err error) *LineError {
+	t.Helper()
+	var le *LineError
+	if !errors.As(err, &le) {
+		t.Fatalf("error %v is not a *LineError", err)
+	}
+	return le
+}
+
+// Checks Convert on in-memory input, with and without a cache
+func TestConvert(t *testing.T) {
+	input := "2x4:10110011\n3:101\n2x4:10110011\n"
+	want := "2x4:B3\n3:A0.3\n2x4:B3\n"
+	for _, cache := range []*Cache[string]{nil, NewCache[string](10)} {
+		var out bytes.Buffer
+		if _, err := Convert(strings.NewReader(input), &out, cache, Options{Direction: Compress}); err != nil || out.String() != want {
+			t.Errorf("convert = %q, %v, want %q", out.String(), err, want)
+		}
+	}
+	c := NewCache[string](10)
+	Convert(strings.NewReader(input), io.Discard, c, Options{Direction: Compress})
+	if s := c.Stats(); s.Hits != 1 || s.Misses != 2 {
+		t.Errorf("Stats() = %+v, want 1 hit and 2 misses", s)
+	}
+}
+
+// Checks that decompressing the compressed file restores the input, with and without the cache
+func TestDirection(t *testing.T) {
+	dir := t.TempDir()
+	in, packed, out := filepath.Join(dir, "mat.in"), filepath.Join(dir, "mat.in.x"), filepath.Join(dir, "mat.out")
+	input := "2x4:10110011\n2x8:1111000000001111\n2x4:10110011\n"
+	if err := os.WriteFile(in, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ConvertWithCache(in, packed, NewCache[string](10), Options{Direction: Compress}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(packed); string(got) != "2x4:B3\n2x8:F00F\n2x4:B3\n" {
+		t.Fatalf("compressed to %q", got)
+	}
+	if _, err := ConvertWithoutCache(packed, out, Options{Direction: Decompress}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(out); string(got) != input {
+		t.Errorf("decompressed to %q, want %q", got, input)
+	}
+}
+
+// Checks convertLine on well-formed and malformed lines
+func TestConvertLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		dir     Direction
+		want    string
+		wantErr string
+	}{
+		{"2x4:10110011", Compress, "2x4:B3", ""},
+		{"2x4:B3", Decompress, "2x4:10110011", ""},
+		{"5:10110", Auto, "5:B0.5", ""},
+		{"5:B0.5", Auto, "5:10110", ""},
+		{"2:10", Auto, "2:80.2", ""},
+		{"2x4:", Compress, "2x4:", ""},
+		{"10110011", Compress, "", `malformed line "10110011": missing ":" separator`},
+		{"", Decompress, "", `malformed line "": missing ":" separator`},
+		{"4:1010:ünits", Compress, "", "malformed line: non-ASCII byte 0xC3 at index 7: input is not plain ASCII text"},
+		{"2x4:B3\xff", Decompress, "", "malformed line: non-ASCII byte 0xFF at index 6: input is not plain ASCII text"},
+	}
+	for _, tt := range tests {
+		got, err := convertLine(tt.line, Options{Direction: tt.dir})
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("convertLine(%q) error = %v, want %q", tt.line, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("convertLine(%q) = %q, %v, want %q", tt.line, got, err, tt.want)
+		}
+	}
+}
+
+// Checks that conversion errors carry the line number
+func TestLineNumbers(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "mat.in")
+	if err := os.WriteFile(in, []byte("2x2:1011\n2x2:10x1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ConvertWithoutCache(in, filepath.Join(dir, "mat.in.x"), Options{Direction: Compress})
+	if want := "line 2 (byte 9): invalid binary character 'x' at index 2"; err == nil || err.Error() != want {
+		t.Errorf("convertWithoutCache error = %v, want %q", err, want)
+	}
+}
+
+// Checks the line, offset and message of conversion errors
+func TestLineErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		opts   Options
+		line   int
+		offset int64
+		want   string
+		is     error
+	}{
+		{"invalid binary", "1:1\n2:12\n", Options{}, 2, 4, "line 2 (byte 4): invalid binary character '2' at index 1", ErrInvalidBinary},
+		{"blank line", "1:1\n\n", Options{}, 2, 4, "", ErrMalformedLine},
+		{"no delimiter", "2:1011\n3:101\nno delimiter\n", Options{}, 3, 13, "", ErrMalformedLine},
+		{"non-ASCII", "4:1010\n4:10é0\n", Options{}, 2, 7, "non-ASCII byte 0xC3 at index 4", ErrMalformedLine},
+		{"odd hex", "8:B3\n5:B.5\n", Options{Direction: Decompress}, 2, 5, `invalid hex value "B": odd length`, ErrInvalidHex},
+		{"bad hex", "1:FF\n2:AG\n", Options{Direction: Decompress}, 2, 5, "", ErrInvalidHex},
+		{"after header", "#format=hex\n8:B3\n8:Z\n", Options{Direction: Decompress}, 3, 17, "", ErrInvalidHex},
+		{"size mismatch", "2:B0.4\n3:B0\n", Options{Direction: Decompress, ValidateSize: true}, 2, 7, "expects 9 bits, got 8", nil},
+		{"trimmed blank lines", "\n\nbad\n", Options{TrimSpace: true}, 3, 2, "", ErrMalformedLine},
+		{"record with newline", "1:1\x00bad\nline\x00", Options{Split: ScanNull}, 2, 4, "", ErrMalformedLine},
+	}
+	for _, tt := range tests {
+		for _, workers := range []int{1, 3} {
+			t.Run(fmt.Sprintf("%s/workers=%d", tt.name, workers), func(t *testing.T) {
+				opts := tt.opts
+				opts.LineWorkers = workers
+				_, _, err := convertString(tt.in, nil, opts)
+				le := lineError(t, err)
+				if le.Line != tt.line || le.Offset != tt.offset {
+					t.Errorf("error at line %d, byte %d, want line %d, byte %d", le.Line, le.Offset, tt.line, tt.offset)
+				}
+				if !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("error %q does not contain %q", err, tt.want)
+				}
+				if tt.is != nil && !errors.Is(err, tt.is) {
+					t.Errorf("error %v is not %v", err, tt.is)
+				}
+			})
+		}
+	}
+}
+
+// Checks that delimiters which could occur inside a value are rejected, also by a header
+func TestDelimiters(t *testing.T) {
+	tests := []struct {
+		delim string
+		opts  Options
+		ok    bool
+	}{
+		{":", Options{}, true},
+		{" => ", Options{}, true},
+		{"", Options{}, false},
+		{".", Options{}, false},
+		{"b", Options{}, false},
+		{"-1-", Options{}, false},
+		{"g", Options{}, true},
+		{"g", Options{Format: FormatBase64}, false},
+		{"+", Options{Format: FormatBase64}, false},
+		{"9", Options{Format: FormatOct}, true},
+		{"9", Options{Format: FormatDec}, false},
+		{",", Options{}, true},
+		{",", Options{Format: FormatRLE}, false},
+		{"x", Options{Format: FormatRLE}, false},
+		{"F", Options{Format: FormatOct}, true},
+		{"F", Options{Format: FormatOct, Checksum: true}, false},
+	}
+	for _, tt := range tests {
+		if err := CheckDelimiter(tt.delim, tt.opts); (err == nil) != tt.ok {
+			t.Errorf("CheckDelimiter(%q, %+v) = %v, want ok %t", tt.delim, tt.opts, err, tt.ok)
+		}
+	}
+	if _, err := ConvertLine("3.101", nil, Options{Delimiter: "."}); err == nil || errors.Is(err, ErrMalformedLine) {
+		t.Errorf("ConvertLine with a . delimiter gave %v", err)
+	}
+	if _, _, err := convertString("3,101\n", nil, Options{Delimiter: ",", Format: FormatRLE, SkipErrors: true}); err == nil {
+		t.Error("Convert with a , delimiter for RLE values succeeded")
+	}
+	if _, _, err := convertString("#format=rle;delim=,\n3,1x3\n", nil, Options{Direction: Decompress}); err == nil {
+		t.Error("a header with a , delimiter for RLE values was accepted")
+	}
+	rle := Options{Format: FormatRLE, OutputDelimiter: ","}
+	if _, _, err := convertString("3:101\n", nil, rle); err == nil || !strings.HasPrefix(err.Error(), "output delimiter") {
+		t.Errorf("Convert with a , output delimiter for RLE values gave %v", err)
+	}
+	if _, err := ConvertLine("3:101", nil, rle); err == nil {
+		t.Error("ConvertLine with a , output delimiter for RLE values succeeded")
+	}
+}
+
+// Checks that ErrMalformedLine and ErrInvalidBinary are told apart, and that file
+// errors are not LineErrors
+func TestTypedErrors(t *testing.T) {
+	_, _, err := convertString("2:1021\n", nil, Options{})
+	if !errors.Is(err, ErrInvalidBinary) || errors.Is(err, ErrMalformedLine) {
+		t.Errorf("invalid bits gave %v", err)
+	}
+	long := "2:" + strings.Repeat("A", streamMinLine) + "G\n"
+	_, _, err = convertString(long, nil, Options{Direction: Decompress, MaxLineSize: 1 << 20})
+	if !errors.Is(err, ErrInvalidHex) || lineError(t, err).Line != 1 {
+		t.Errorf("streamed invalid hex gave %v", err)
+	}
+	_, err = ConvertFile("/nonexistent/in", filepath.Join(t.TempDir(), "out"), nil, Options{})
+	var le *LineError
+	if !errors.Is(err, fs.ErrNotExist) || errors.As(err, &le) {
+		t.Errorf("missing input gave %v", err)
+	}
+}
+
+// Checks that VerifyFile counts lines and the ones that fail to round-trip
+func TestVerifyFile(t *testing.T) {
+	in := filepath.Join(t.TempDir(), "mat.in")
+	if err := os.WriteFile(in, []byte("2x4:10110011\n3:101\nno colon\n2x2:10x1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lines, mismatches, err := VerifyFile(in, Options{})
+	if err != nil || lines != 4 || mismatches != 2 {
+		t.Errorf("verifyFile = %d, %d, %v, want 4 lines and 2 mismatches", lines, mismatches, err)
+	}
+}
+
+// Checks that "-" reads stdin and writes stdout, and that stdout is left open
+func TestStdio(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "mat.in"), filepath.Join(dir, "stdout")
+	if err := os.WriteFile(in, []byte("2x4:10110011\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := os.Open(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	stdout, err := os.Create(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	defer func(in, out *os.File) { os.Stdin, os.Stdout = in, out }(os.Stdin, os.Stdout)
+	os.Stdin, os.Stdout = stdin, stdout
+	if _, err := ConvertWithoutCache(Stdio, Stdio, Options{Direction: Compress}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stdout.WriteString("open\n"); err != nil {
+		t.Errorf("stdout closed after the conversion: %v", err)
+	}
+	if got, _ := os.ReadFile(out); string(got) != "2x4:B3\nopen\n" {
+		t.Errorf("stdout = %q", got)
+	}
+}
+
+// Checks that the files of a batch Convert on several workers, with and without caches
+func TestConvertFiles(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	var jobs []FileJob
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprint("m", i)
+		os.WriteFile(filepath.Join(in, name), []byte("2x4:10110011\n3:101\n"), 0o644)
+		jobs = append(jobs, FileJob{InputFile: filepath.Join(in, name), OutputFile: filepath.Join(out, name+".x")})
+	}
+	for _, newCache := range []func() *Cache[string]{nil, func() *Cache[string] { return NewCache[string](10) }} {
+		if _, err := ConvertFiles(jobs, 2, newCache, Options{Direction: Compress}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			if got, _ := os.ReadFile(filepath.Join(out, fmt.Sprint("m", i, ".x"))); string(got) != "2x4:B3\n3:A0.3\n" {
+				t.Errorf("m%d.x = %q", i, got)
+			}
+		}
+	}
+	jobs = append(jobs, FileJob{InputFile: filepath.Join(in, "missing"), OutputFile: filepath.Join(out, "missing.x")})
+	summary, err := ConvertFiles(jobs, 3, nil, Options{Direction: Compress})
+	if err == nil || !strings.Contains(err.Error(), "missing: open") || summary.FailedFiles != 1 || summary.Lines != 10 {
+		t.Errorf("ConvertFiles = %+v, %v, want 10 lines and the missing file failed", summary, err)
+	}
+}
+
+// Checks that a cache shared between files does not reuse lines converted under another header
+func TestConvertFilesHeaderCache(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	var jobs []FileJob
+	for _, order := range []string{"msb", "lsb"} {
+		input := writeFile(t, in, order, "#format=hex;delim=:;bitorder="+order+";align=1;checksum=false\n3:B580.9\n")
+		jobs = append(jobs, FileJob{InputFile: input, OutputFile: filepath.Join(out, order+".x")})
+	}
+	for _, newCache := range []func() *Cache[string]{nil, func() *Cache[string] { return NewCache[string](10) }} {
+		if _, err := ConvertFiles(jobs, 1, newCache, Options{Direction: Decompress}); err != nil {
+			t.Fatal(err)
+		}
+		msb, lsb := readOutput(t, jobs[0].OutputFile), readOutput(t, jobs[1].OutputFile)
+		if msb != "3:101101011\n" || lsb != "3:101011010\n" {
+			t.Errorf("cached %t: got %q and %q", newCache != nil, msb, lsb)
+		}
+	}
+}
+
+// Checks that converting lines in parallel keeps their order and reports the first bad line
+func TestParallelLines(t *testing.T) {
+	var in, want strings.Builder
+	for i := 0; i < 3*parallelBatchSize+7; i++ {
+		bits := fmt.Sprintf("%b", i)
+		fmt.Fprintf(&in, "%d:%s\n", len(bits), bits)
+		converted, _ := BinToHex(bits)
+		fmt.Fprintf(&want, "%d:%s\n", len(bits), converted)
+	}
+	for _, workers := range []int{1, 2, 7} {
+		for _, cache := range []*Cache[string]{nil, NewCache[string](100)} {
+			var out bytes.Buffer
+			_, err := Convert(strings.NewReader(in.String()), &out, cache, Options{Direction: Compress, LineWorkers: workers})
+			if err != nil || out.String() != want.String() {
+				t.Errorf("%d workers: Convert differs from the serial conversion, %v", workers, err)
+			}
+		}
+	}
+	bad := strings.Repeat("1:1\n", parallelBatchSize+5) + "1:2\n1:x\n"
+	_, err := Convert(strings.NewReader(bad), io.Discard, nil, Options{Direction: Compress, LineWorkers: 4})
+	if le := lineError(t, err); le.Line != parallelBatchSize+6 || le.Offset != int64(4*(parallelBatchSize+5)) {
+		t.Errorf("convert error = %v, want line %d", err, parallelBatchSize+6)
+	}
+}
+
+// Checks the delimiter, CRLF, buffer size and trim options
+func TestLineOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		opts  Options
+		want  string
+	}{
+		{"default", "2x4:10110011\n", Options{}, "2x4:B3\n"},
+		{"delimiter", "2x4;10110011\n", Options{Delimiter: ";"}, "2x4;B3\n"},
+		{"long delimiter", "2x4 => 10110011\n", Options{Delimiter: " => "}, "2x4 => B3\n"},
+		{"crlf", "2x4:10110011\n3:101\n", Options{CRLF: true}, "2x4:B3\r\n3:A0.3\r\n"},
+		{"tiny buffer", "2x4:10110011\n3:101\n", Options{BufferSize: 16}, "2x4:B3\n3:A0.3\n"},
+		{"trim space", "3:101 \n 5 : 10110\r\n\n  \n", Options{TrimSpace: true}, "3:A0.3\n5:B0.5\n"},
+		{"trailing fields", "3:101010:label\n3:1:a:b\n", Options{}, "3:A8.6:label\n3:80.1:a:b\n"},
+		{"output delimiter", "3:1010\n", Options{OutputDelimiter: ","}, "3,A0.4\n"},
+		{"comments", "# hand-edited\n2:1011\n\n# two\n3:101\n\n", Options{CommentPrefix: "#"}, "2:B0.4\n3:A0.3\n"},
+		{"keep comments", "# hand-edited\n2:1011\n\n3:101\n", Options{CommentPrefix: "#", KeepComments: true}, "# hand-edited\n2:B0.4\n\n3:A0.3\n"},
+		{"comment before decompress", "# notes\n2:B0.4\n", Options{CommentPrefix: "#", Direction: Decompress}, "2:1011\n"},
+		{"dedup", "2:1011\n3:101\n2:1011\n1:1\n3:101\n2:1011\n", Options{Dedup: true}, "2:B0.4\n3:A0.3\n1:80.1\n"},
+		{"sort by size", "3:101\n1:1\n2x3:101100\n2:1011\nbad:1\n1:0\n2:0000\n", Options{SortBySize: true}, "1:80.1\n1:00.1\n2:B0.4\n2:00.4\n2x3:B0.6\n3:A0.3\nbad:80.1\n"},
+		{"sort by size numerically", "10:1\n2:1\n", Options{SortBySize: true, OutputDelimiter: ","}, "2,80.1\n10,80.1\n"},
+		{"null records", "2:1011\x003:101\x001:1", Options{Split: ScanNull, RecordSeparator: "\x00"}, "2:B0.4\x003:A0.3\x001:80.1\x00"},
+		{"limit", "1:1\n1:0\n1:1\n", Options{Limit: 2}, "1:80.1\n1:00.1\n"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if _, err := Convert(strings.NewReader(tt.input), &out, nil, tt.opts); err != nil || out.String() != tt.want {
+			t.Errorf("%s: Convert = %q, %v, want %q", tt.name, out.String(), err, tt.want)
+		}
+	}
+	if lines, mismatches, err := Verify(strings.NewReader("3:101\n\n  \n5:10110\n"), Options{TrimSpace: true}); lines != 2 || mismatches != 0 || err != nil {
+		t.Errorf("trimmed Verify = %d, %d, %v, want 2 lines and no mismatches", lines, mismatches, err)
+	}
+	summed, err := convertLine("3:101010:label", Options{Checksum: true})
+	if back, _ := convertLine(summed, Options{Direction: Decompress, Checksum: true}); err != nil || back != "3:101010:label" {
+		t.Errorf("checksummed trailing fields %q gave back %q, %v", summed, back, err)
+	}
+	_, err = convertLine("2x4:10110011", Options{Delimiter: ";"})
+	if want := `malformed line "2x4:10110011": missing ";" separator`; err == nil || err.Error() != want {
+		t.Errorf("convertLine error = %v, want %q", err, want)
+	}
+}
+
+// Checks that checksummed lines round-trip and that a corrupted value is caught
+func TestChecksum(t *testing.T) {
+	in := "8:10101011\n4:1111\n8:00000001\n"
+	out, _, err := convertString(in, nil, Options{Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first, _, _ := strings.Cut(out, "\n"); first != "8:AB:"+bitsChecksum("10101011") {
+		t.Errorf("first line = %q", first)
+	}
+	back, _, err := convertString(out, nil, Options{Checksum: true, Direction: Decompress})
+	if err != nil || back != in {
+		t.Fatalf("checksummed round trip gave %q, %v", back, err)
+	}
+	lines := strings.Split(out, "\n")
+	lines[1] = strings.Replace(lines[1], "F0", "E0", 1)
+	_, _, err = convertString(strings.Join(lines, "\n"), nil, Options{Checksum: true, Direction: Decompress})
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2 (byte 14): checksum mismatch") {
+		t.Errorf("corrupted value gave %v", err)
+	}
+	if _, _, err := convertString("8:AB\n", nil, Options{Checksum: true, Direction: Decompress}); err == nil {
+		t.Error("a line without a checksum field was accepted")
+	}
+}
+
+// Checks -validate-size against square and rectangular sizes
+func TestValidateSize(t *testing.T) {
+	tests := []struct {
+		line string
+		dir  Direction
+		ok   bool
+	}{
+		{"2:1011", Compress, true},
+		{"2x3:101100", Compress, true},
+		{"3:1011", Compress, false},
+		{"abc:1", Compress, false},
+		{"2x-1:", Compress, false},
+		{"2:B0.4", Decompress, true},
+		{"2:B0", Decompress, false},
+	}
+	for _, tt := range tests {
+		_, err := convertLine(tt.line, Options{ValidateSize: true, Direction: tt.dir})
+		if (err == nil) != tt.ok {
+			t.Errorf("convertLine(%q) error = %v, want ok %v", tt.line, err, tt.ok)
+		}
+	}
+	_, err := convertLine("3:1011", Options{ValidateSize: true})
+	if want := "matrix size 3 expects 9 bits, got 4"; err == nil || err.Error() != want {
+		t.Errorf("convertLine error = %v, want %q", err, want)
+	}
+	long := "1000:" + strings.Repeat("AB", streamMinLine) + "\n"
+	_, _, err = convertString(long, nil, Options{ValidateSize: true, Direction: Decompress, MaxLineSize: 1 << 20})
+	if le := lineError(t, err); le.Line != 1 {
+		t.Errorf("streamed line error at line %d", le.Line)
+	}
+}
+
+// Checks the line and error counts of a conversion
+func TestSummary(t *testing.T) {
+	_, summary, err := convertString("3:101\n3:101\n3:1x1\n", nil, Options{})
+	if err == nil || summary.Lines != 2 || summary.Errors != 1 {
+		t.Errorf("convert summary = %+v, %v, want 2 lines and 1 error", summary, err)
+	}
+}
+
+// slowReader repeats one line forever, sleeping before each read
+type slowReader struct{}
+
+func (slowReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return copy(p, "8:10101010\n"), nil
+}
+
+// Checks that ConvertContext stops on cancellation and keeps what it converted
+func TestCancel(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		var out bytes.Buffer
+		start := time.Now()
+		summary, err := ConvertContext(ctx, slowReader{}, &out, nil, Options{LineWorkers: workers})
+		if !errors.Is(err, context.Canceled) || time.Since(start) > 2*time.Second {
+			t.Fatalf("workers=%d: got %v after %v", workers, err, time.Since(start))
+		}
+		if workers == 1 && (summary.Lines == 0 || out.Len() != summary.Lines*len("8:AA\n")) {
+			t.Errorf("kept %d bytes for %d lines", out.Len(), summary.Lines)
+		}
+	}
+}
+
+// Checks that NoClobber leaves an existing output untouched
+func TestNoClobber(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	os.WriteFile(in, []byte("3:101\n"), 0o644)
+	os.WriteFile(out, []byte("keep"), 0o644)
+	_, err := ConvertWithoutCache(in, out, Options{NoClobber: true})
+	if got, _ := os.ReadFile(out); !errors.Is(err, fs.ErrExist) || string(got) != "keep" {
+		t.Errorf("ConvertWithoutCache = %v and left %q, want fs.ErrExist and keep", err, got)
+	}
+	if _, err := ConvertWithoutCache(in, filepath.Join(dir, "new"), Options{NoClobber: true}); err != nil {
+		t.Errorf("NoClobber refused a new output: %v", err)
+	}
+}
+
+// Checks that Progress reports every line once
+func TestProgress(t *testing.T) {
+	n := 3*progressInterval + 17
+	in := strings.Repeat("3:101\n", n)
+	for _, workers := range []int{1, 4} {
+		total := 0
+		opts := Options{LineWorkers: workers, Progress: func(lines int) { total += lines }}
+		if _, _, err := convertString(in, nil, opts); err != nil || total != n {
+			t.Errorf("workers=%d: reported %d lines, want %d, %v", workers, total, n, err)
+		}
+	}
+}
+
+// Checks that ".gz" inputs and outputs are decompressed and compressed
+func TestGzip(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("3:101\n5:10110\n"))
+	gz.Close()
+	inputFile := writeFile(t, dir, "m.in.gz", buf.String())
+	outputFile := filepath.Join(dir, "m.x.gz")
+	if _, err := ConvertFile(inputFile, outputFile, nil, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, outputFile); got != "3:A0.3\n5:B0.5\n" {
+		t.Errorf("gzip output %q", got)
+	}
+	if _, err := ConvertFile(outputFile, filepath.Join(dir, "back.gz"), nil, Options{Direction: Decompress}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, filepath.Join(dir, "back.gz")); got != "3:101\n5:10110\n" {
+		t.Errorf("gzip round trip %q", got)
+	}
+}
+
+// Checks that SkipErrors drops bad lines, reporting each to OnSkip
+func TestSkipErrors(t *testing.T) {
+	in := "3:101\nbad\n3:1x1\n5:10110\n"
+	for _, workers := range []int{1, 3} {
+		var skipped []string
+		opts := Options{LineWorkers: workers, SkipErrors: true, OnSkip: func(err error) { skipped = append(skipped, err.Error()) }}
+		got, summary, err := convertString(in, nil, opts)
+		if err != nil || got != "3:A0.3\n5:B0.5\n" {
+			t.Fatalf("workers=%d: got %q, %v", workers, got, err)
+		}
+		if summary.Errors != 2 || summary.Lines != 2 || len(skipped) != 2 || !strings.HasPrefix(skipped[1], "line 3 (byte 10):") {
+			t.Errorf("workers=%d: summary %+v, skipped %q", workers, summary, skipped)
+		}
+	}
+	_, _, err := convertString(in, nil, Options{LineWorkers: 3})
+	if le := lineError(t, err); le.Line != 2 || le.Content != "bad" {
+		t.Errorf("strict mode gave %v for line %q", err, le.Content)
+	}
+}
+
+// Checks ConvertLine and its use of the cache
+func TestConvertLineCache(t *testing.T) {
+	cache := NewCache[string](4)
+	for i := 0; i < 2; i++ {
+		if got, err := ConvertLine("5:10110", cache, Options{}); err != nil || got != "5:B0.5" {
+			t.Fatalf("ConvertLine = %q, %v", got, err)
+		}
+	}
+	if s := cache.Stats(); s.Hits != 1 || s.Misses != 1 {
+		t.Errorf("Stats() = %+v, want one hit and one miss", s)
+	}
+	if got, err := ConvertLine("  ", nil, Options{TrimSpace: true}); err != nil || got != "" {
+		t.Errorf("blank line gave %q, %v", got, err)
+	}
+	tests := []struct {
+		line string
+		opts Options
+		want string
+		ok   bool
+	}{
+		{"10110", Options{}, "", false},
+		{"// x", Options{CommentPrefix: "//", KeepComments: true}, "// x", true},
+		{"3:101100110", Options{SizeField: SquareSize}, "3x3:B300.9", true},
+		{"2x4:10110011", Options{SizeField: SquareSize}, "2x4:B3", true},
+		{"q:1", Options{SizeField: SquareSize}, "", false},
+		{"8:10110011:a:b", Options{OutputDelimiter: ",", Checksum: true}, "8,B3," + bitsChecksum("10110011") + ",a,b", true},
+		{"8,B3," + bitsChecksum("10110011") + ",a,b", Options{Direction: Decompress, Delimiter: ",", OutputDelimiter: ":", Checksum: true}, "8:10110011:a:b", true},
+	}
+	for _, tt := range tests {
+		got, err := ConvertLine(tt.line, nil, tt.opts)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ConvertLine(%q) = %q, %v, want %q", tt.line, got, err, tt.want)
+		}
+	}
+	prefix := func(size string) (string, error) { return "n" + size, nil }
+	if got, _ := ConvertLine("8:B3:tail", nil, Options{Direction: Decompress, SizeField: prefix}); got != "n8:10110011:tail" {
+		t.Errorf("SizeField on decompression gave %q", got)
+	}
+}
+
+// Checks that WarmCache preloads computed and given outputs
+func TestWarmCache(t *testing.T) {
+	cache := NewCache[string](2)
+	n, err := WarmCache(cache, strings.NewReader("3:101 -> 3:XYZ\n\n5:10110\n3:111\n"), Options{TrimSpace: true})
+	if err != nil || n != 3 || cache.Len() != 2 || cache.Contains("3:101") {
+		t.Fatalf("warmed %d lines, %v, keys %v", n, err, cache.Keys())
+	}
+	cache = NewCache[string](4)
+	WarmCache(cache, strings.NewReader("3:101 -> 3:XYZ\n"), Options{})
+	if got, _, _ := convertString("3:101\n", cache, Options{}); got != "3:XYZ\n" || cache.Stats().Hits != 1 {
+		t.Errorf("warmed output not used: %q", got)
+	}
+	if _, err := WarmCache(cache, strings.NewReader("x\n"), Options{}); lineError(t, err).Line != 1 {
+		t.Errorf("bad warm line gave %v", err)
+	}
+}
+
+// Checks that ConvertLines keeps one result per line and reports the first failure
+func TestConvertLines(t *testing.T) {
+	results, err := ConvertLines([]string{"3:101", "bad", "5:10110"}, NewCache[string](4), Options{})
+	if le := lineError(t, err); !errors.Is(err, ErrMalformedLine) || le.Line != 2 || le.Content != "bad" || len(results) != 3 {
+		t.Fatalf("got %d results, %v", len(results), err)
+	}
+	if results[0].Output != "3:A0.3" || results[1].Err == nil || results[2].Output != "5:B0.5" {
+		t.Errorf("results %+v", results)
+	}
+}
+
+// Checks Verify, which round-trips each line without writing it
+func TestVerify(t *testing.T) {
+	identity := func(bits string) (string, error) { return bits, nil }
+	tests := []struct {
+		name string
+		in   string
+		opts Options
+	}{
+		{"output delimiter", "3:1010:x\n8:11110000\n", Options{OutputDelimiter: ","}},
+		{"null records", "2:1011\x003:101", Options{Split: ScanNull}},
+		{"transform", "2:1100\n3:100\n", Options{Transform: identity, InverseTransform: identity}},
+	}
+	for _, tt := range tests {
+		if lines, bad, err := Verify(strings.NewReader(tt.in), tt.opts); lines != 2 || bad != 0 || err != nil {
+			t.Errorf("%s: Verify = %d, %d, %v", tt.name, lines, bad, err)
+		}
+	}
+}
+
+// Checks the defaults and limits of Options.MaxLineSize
+func TestMaxLineSize(t *testing.T) {
+	in := "100000:" + strings.Repeat("1", 100000) + "\n"
+	_, _, err := convertString(in, nil, Options{})
+	if !errors.Is(err, bufio.ErrTooLong) || !strings.Contains(err.Error(), "65536 byte limit") {
+		t.Errorf("long line gave %v", err)
+	}
+	got, _, err := convertString(in, nil, Options{MaxLineSize: 1 << 20, LineWorkers: 2})
+	if err != nil || !strings.HasPrefix(got, "100000:FFFF") {
+		t.Errorf("raised limit gave %v", err)
+	}
+}
+
+// Checks that long hex lines are streamed, match the parallel path and stay out of the cache
+func TestStreamDecode(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	var bits strings.Builder
+	for i := 0; i < 4<<20+5; i++ {
+		bits.WriteByte('0' + byte(rng.Intn(2)))
+	}
+	for _, opts := range []Options{{}, {LSBFirst: true, Align: 4}} {
+		enc, _ := EncodeBits(bits.String(), opts)
+		small, _ := EncodeBits("1010", opts)
+		in := "2048x2048:" + enc + ":tail\n4:" + small + "\n9:" + strings.Repeat("AB", 40000) + "Z\n"
+		want := "2048x2048:" + bits.String() + ":tail\n4:1010\n"
+		dopts := opts
+		dopts.Direction = Decompress
+		dopts.MaxLineSize = 8 << 20
+		dopts.SkipErrors = true
+		cache := NewCache[string](10)
+		got, summary, err := convertString(in, cache, dopts)
+		if err != nil || got != want {
+			t.Fatalf("%+v: got %d bytes, %v", opts, len(got), err)
+		}
+		if summary.Lines != 2 || summary.Errors != 1 || summary.OutputBytes != int64(len(want)) {
+			t.Errorf("%+v: summary %+v", opts, summary)
+		}
+		if cache.Len() != 1 {
+			t.Errorf("%+v: cached %d lines, want only the short one", opts, cache.Len())
+		}
+		dopts.LineWorkers = 2
+		if got, _, _ := convertString(in, nil, dopts); got != want {
+			t.Errorf("%+v: parallel output differs", opts)
+		}
+	}
+}
+
+// Checks that Resume appends the missing lines to a partial output
+func TestResume(t *testing.T) {
+	dir := t.TempDir()
+	var in strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&in, "%d:%b\n", i, i*7919)
+	}
+	inputFile := writeFile(t, dir, "in", in.String())
+	lines := strings.SplitAfter(in.String(), "\n")
+	for _, name := range []string{"out", "out.gz"} {
+		full := filepath.Join(dir, "full"+name)
+		if _, err := ConvertFile(inputFile, full, nil, Options{}); err != nil {
+			t.Fatal(err)
+		}
+		// Write the first 400 lines as an interrupted run would
+		partial := filepath.Join(dir, name)
+		w, err := openOutput(partial, os.O_TRUNC, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Convert(strings.NewReader(strings.Join(lines[:400], "")), w, nil, Options{})
+		w.Close()
+		summary, err := ConvertFile(inputFile, partial, nil, Options{Resume: true, LineWorkers: 2})
+		if err != nil || summary.Lines != 600 {
+			t.Fatalf("%s: resumed %d lines, %v", name, summary.Lines, err)
+		}
+		if readOutput(t, partial) != readOutput(t, full) {
+			t.Errorf("%s: resumed output differs from a full run", name)
+		}
+	}
+	mid := writeFile(t, dir, "mid", "3:A0.3\n3:A")
+	if _, err := ConvertFile(inputFile, mid, nil, Options{Resume: true}); err == nil || !strings.Contains(err.Error(), "mid-line") {
+		t.Errorf("output ending mid-line gave %v", err)
+	}
+	header := "#format=hex;delim=:;bitorder=msb;align=1;checksum=false\n"
+	short := writeFile(t, dir, "short", "3:101\n3:111\n")
+	out := writeFile(t, dir, "header", header+"3:A0.3\n")
+	if _, err := ConvertFile(short, out, nil, Options{Header: true, Resume: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOutput(t, out); got != header+"3:A0.3\n3:E0.3\n" {
+		t.Errorf("resumed with a header: %q", got)
+	}
+	if _, err := ConvertFile(short, out, nil, Options{Split: ScanNull, Resume: true}); err == nil {
+		t.Error("Resume accepted with a custom Split")
+	}
+	if _, err := ConvertFile(inputFile, mid, nil, Options{Resume: true, SkipErrors: true}); err == nil {
+		t.Error("Resume accepted with SkipErrors")
+	}
+	_, _, err := convertString("3:101\n3:1x1\n", nil, Options{SkipLines: 1})
+	if lineError(t, err).Line != 2 {
+		t.Errorf("skipped lines gave %v, want the error numbered line 2", err)
+	}
+}
+
+// Checks the statistics gathered by Count
+func TestCount(t *testing.T) {
+	counts, err := Count(strings.NewReader("3:101\n3:1\n4:1111111\nnope\n2:12\n3:10:tail\n"), Options{})
+	want := Counts{Lines: 6, Malformed: 2, Sizes: 2, MinBits: 1, MaxBits: 7, AvgBits: 13.0 / 4, SetBits: map[int]int{1: 2, 2: 1, 7: 1}}
+	if err != nil || fmt.Sprint(counts) != fmt.Sprint(want) {
+		t.Errorf("Count = %+v, %v, want %+v", counts, err, want)
+	}
+}
+
+// Checks that Atomic leaves no output on failure and keeps the mode of a replaced file
+func TestAtomic(t *testing.T) {
+	dir := t.TempDir()
+	bad := writeFile(t, dir, "bad", strings.Repeat("3:101\n", 5000)+"bad\n")
+	if _, err := ConvertFile(bad, filepath.Join(dir, "out"), nil, Options{Atomic: true}); err == nil {
+		t.Fatal("bad input converted")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("failed atomic run left %d files", len(entries))
+	}
+	out := filepath.Join(dir, "out")
+	os.WriteFile(out, []byte("old"), 0o600)
+	good := writeFile(t, dir, "good", "3:101\n")
+	if _, err := ConvertFile(good, out, nil, Options{Atomic: true, NoClobber: true}); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("NoClobber gave %v", err)
+	}
+	if _, err := ConvertFile(good, out, nil, Options{Atomic: true}); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(out)
+	if got := readOutput(t, out); got != "3:A0.3\n" || info.Mode().Perm() != 0o600 {
+		t.Errorf("replaced output %q with mode %v", got, info.Mode())
+	}
+	gz := filepath.Join(dir, "o.gz")
+	if _, err := ConvertFile(good, gz, nil, Options{Atomic: true}); err != nil || readOutput(t, gz) != "3:A0.3\n" {
+		t.Errorf("atomic gzip output: %v", err)
+	}
+}
+
+// Checks the header written with Header and read back on decompression
+func TestHeader(t *testing.T) {
+	opts := Options{Header: true, Format: FormatBase64, Delimiter: "|", LSBFirst: true, Align: 2, Checksum: true}
+	out, _, err := convertString("5|10110\n", nil, opts)
+	if err != nil || !strings.HasPrefix(out, "#format=base64;delim=|;bitorder=lsb;align=2;checksum=true\n") {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	if back, _, err := convertString(out, nil, Options{Direction: Decompress}); err != nil || back != "5|10110\n" {
+		t.Errorf("decompressed with the header to %q, %v", back, err)
+	}
+	if _, _, err := convertString("#format=nope\n", nil, Options{Direction: Decompress}); err == nil {
+		t.Error("unknown header format accepted")
+	}
+	out, _, _ = convertString("3:1010\n", nil, Options{OutputDelimiter: ",", Header: true})
+	if back, _, err := convertString(out, nil, Options{Direction: Decompress}); err != nil || back != "3,1010\n" {
+		t.Errorf("header with output delimiter gave %q, %v", back, err)
+	}
+	for _, delim := range []string{";", "=", "%;"} {
+		out, _, _ = convertString("3|1010\n", nil, Options{Delimiter: "|", OutputDelimiter: delim, Header: true})
+		if back, _, err := convertString(out, nil, Options{Direction: Decompress}); err != nil || back != "3"+delim+"1010\n" {
+			t.Errorf("header with delimiter %q gave %q, %v", delim, back, err)
+		}
+	}
+	in := "2:1011\x003:101\x001:1"
+	nul := Options{Split: ScanNull, RecordSeparator: "\x00", Header: true}
+	out, _, _ = convertString(in, nil, nul)
+	nul.Header, nul.Direction = false, Decompress
+	if back, _, err := convertString(out, nil, nul); err != nil || back != in+"\x00" {
+		t.Errorf("null records with a header gave %q, %v", back, err)
+	}
+	_, _, err = convertString("#format=hex\n3:A0.3\n3:XY\n", nil, Options{Direction: Decompress})
+	if le := lineError(t, err); le.Line != 3 || le.Offset != 19 {
+		t.Errorf("bad line after a header gave %v, want it numbered line 3 at byte 19", err)
+	}
+}
+
+// Checks that Summary counts the bytes read and written
+func TestByteCounts(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := writeFile(t, dir, "a.in", "8:10101010\n16:1111000011110000\n4:1011\n")
+	outputFile := filepath.Join(dir, "a.x")
+	summary, err := ConvertFile(inputFile, outputFile, nil, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, _ := os.Stat(inputFile)
+	out, _ := os.Stat(outputFile)
+	if summary.InputBytes != in.Size() || summary.OutputBytes != out.Size() || summary.Ratio() <= 0 || summary.Ratio() >= 1 {
+		t.Errorf("summary %+v for %d input and %d output bytes", summary, in.Size(), out.Size())
+	}
+}
+
+// Checks the chunks written with SplitLines
+func TestSplitLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		out    string
+		opts   Options
+		counts []int
+	}{
+		{"partial last chunk", "a.x", Options{SplitLines: 10, BufferSize: 16, Atomic: true}, []int{10, 10, 5}},
+		{"with header", "h.x.gz", Options{SplitLines: 5, Header: true}, []int{6, 6, 6, 6, 6}},
+	}
+	dir := t.TempDir()
+	var in strings.Builder
+	for i := 0; i < 25; i++ {
+		fmt.Fprintf(&in, "8:%08b\n", i)
+	}
+	inputFile := writeFile(t, dir, "a.in", in.String())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputFile := filepath.Join(dir, tt.out)
+			summary, err := ConvertFile(inputFile, outputFile, nil, tt.opts)
+			if err != nil || summary.Lines != 25 {
+				t.Fatalf("converted %d lines, %v", summary.Lines, err)
+			}
+			for i, want := range tt.counts {
+				data := readOutput(t, chunkName(outputFile, i))
+				if strings.Count(data, "\n") != want || !strings.HasSuffix(data, "\n") {
+					t.Errorf("chunk %d holds %q", i, data)
+				}
+			}
+			if _, err := os.Stat(chunkName(outputFile, len(tt.counts))); err == nil {
+				t.Error("extra chunk written")
+			}
+			if _, err := os.Stat(outputFile); err == nil {
+				t.Error("unsplit output written")
+			}
+		})
+	}
+	if _, err := ConvertFile(inputFile, filepath.Join(dir, "a.x"), nil, Options{SplitLines: 10, NoClobber: true}); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("NoClobber over chunks gave %v", err)
+	}
+}
+
+// Checks the buckets of Counts.Histogram
+func TestHistogram(t *testing.T) {
+	counts, err := Count(strings.NewReader("4:0000\n4:1000\n4:1100\n4:1010\n4:1111\n8:11111110\nbad\n"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int]int{0: 1, 1: 1, 2: 2, 4: 1, 7: 1}; fmt.Sprint(counts.SetBits) != fmt.Sprint(want) {
+		t.Errorf("SetBits = %v, want %v", counts.SetBits, want)
+	}
+	if got, want := counts.Histogram(3), []Bucket{{0, 2, 4}, {3, 5, 1}, {6, 8, 1}}; !slices.Equal(got, want) {
+		t.Errorf("Histogram(3) = %v, want %v", got, want)
+	}
+	if got := (Counts{}).Histogram(2); len(got) != 0 {
+		t.Errorf("empty Histogram = %v", got)
+	}
+}
+
+// Checks that AutoCache drops the cache for unique lines and keeps it for repeats
+func TestAutoCache(t *testing.T) {
+	var in strings.Builder
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&in, "16:%016b\n", i)
+	}
+	want, _, _ := convertString(in.String(), nil, Options{})
+	for _, workers := range []int{1, 4} {
+		cache := NewCache[string](0)
+		got, summary, err := convertString(in.String(), cache, Options{AutoCache: 100, LineWorkers: workers})
+		if err != nil || summary.Uncached != 1 || got != want {
+			t.Errorf("workers=%d: summary %+v, %v", workers, summary, err)
+		}
+		if cache.Len() > 4096 {
+			t.Errorf("workers=%d: cached %d lines after giving up", workers, cache.Len())
+		}
+	}
+	cache := NewCache[string](0)
+	_, summary, _ := convertString(strings.Repeat("4:1010\n4:0101\n", 500), cache, Options{AutoCache: 100})
+	if summary.Uncached != 0 || cache.Stats().Hits != 998 {
+		t.Errorf("repeated lines: summary %+v, stats %+v", summary, cache.Stats())
+	}
+}
+
+// Checks the counts of duplicates and that the output is unchanged without Dedup
+func TestDedup(t *testing.T) {
+	in := "2:1011\n3:101\n2:1011\n1:1\n3:101\n2:1011\n"
+	if _, summary, _ := convertString(in, NewCache[string](4), Options{Dedup: true}); summary.Duplicates != 3 || summary.Lines != 3 {
+		t.Errorf("Dedup summary %+v", summary)
+	}
+	if _, summary, _ := convertString(in, nil, Options{}); summary.Duplicates != 0 || summary.Lines != 6 {
+		t.Errorf("summary %+v without Dedup", summary)
+	}
+}
+
+// Checks that comments bypass the cache and the line counts
+func TestComments(t *testing.T) {
+	in := "# hand-edited\n2:1011\n\n# section two\n3:101\n\n"
+	opts := Options{CommentPrefix: "#"}
+	cache := NewCache[string](4)
+	_, summary, err := convertString(in, cache, opts)
+	if err != nil || summary.Lines != 2 || summary.Errors != 0 || cache.Stats().Misses != 2 {
+		t.Errorf("summary %+v, stats %+v, %v", summary, cache.Stats(), err)
+	}
+	if _, _, err := convertString(in, nil, Options{}); err == nil {
+		t.Error("comment accepted without CommentPrefix")
+	}
+	if counts, err := Count(strings.NewReader(in), opts); err != nil || counts.Lines != 2 || counts.Malformed != 0 {
+		t.Errorf("Count = %+v, %v", counts, err)
+	}
+}
+
+// Checks that Sample keeps a seeded, ordered subset of the lines
+func TestSample(t *testing.T) {
+	var in strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&in, "%d:%b\n", i, i)
+	}
+	sample := func(seed int64, workers int) string {
+		out, summary, err := convertString(in.String(), nil, Options{Sample: 10, Seed: seed, LineWorkers: workers})
+		if err != nil || summary.Lines != 10 {
+			t.Fatalf("sampled %d lines, %v", summary.Lines, err)
+		}
+		return out
+	}
+	a := sample(42, 1)
+	if b := sample(42, 4); a != b {
+		t.Errorf("seed 42 gave %q and %q", a, b)
+	}
+	if c := sample(7, 1); c == a {
+		t.Error("seed ignored")
+	}
+	prev := -1
+	for _, line := range strings.Split(strings.TrimSpace(a), "\n") {
+		n, _ := strconv.Atoi(strings.Split(line, ":")[0])
+		if n <= prev {
+			t.Fatalf("sample out of input order: %q", a)
+		}
+		prev = n
+	}
+	if out, _, _ := convertString("1:1\n1:0\n", nil, Options{Sample: 5}); out != "1:80.1\n1:00.1\n" {
+		t.Errorf("short input sampled to %q", out)
+	}
+}
+
+// Checks that the reservoir picks each line about equally often
+func TestReservoirUniform(t *testing.T) {
+	hits := make([]int, 20)
+	for seed := int64(1); seed <= 2000; seed++ {
+		r := newReservoir(5, seed)
+		for i := 0; i < 20; i++ {
+			r.add(strconv.Itoa(i))
+		}
+		for _, line := range r.lines() {
+			n, _ := strconv.Atoi(line)
+			hits[n]++
+		}
+	}
+	for i, n := range hits {
+		if n < 350 || n > 650 {
+			t.Errorf("line %d picked %d times, want about 500", i, n)
+		}
+	}
+}
+
+// Checks the Transform and InverseTransform hooks and their errors
+func TestTransform(t *testing.T) {
+	reverse := func(bits string) (string, error) {
+		b := []byte(bits)
+		slices.Reverse(b)
+		return string(b), nil
+	}
+	in := "2:1100\n3:100\n4:1110000000000000:tail\n"
+	opts := Options{Transform: reverse, InverseTransform: reverse, Checksum: true}
+	out, _, err := convertString(in, NewCache[string](4), opts)
+	if err != nil || !strings.HasPrefix(out, "2:30.4:") {
+		t.Fatalf("transformed output %q, %v", out, err)
+	}
+	opts.Direction = Decompress
+	if back, _, err := convertString(out, nil, opts); err != nil || back != in {
+		t.Errorf("inverse transform gave %q, %v", back, err)
+	}
+	boom := errors.New("boom")
+	_, _, err = convertString("1:1\n", nil, Options{Transform: func(string) (string, error) { return "", boom }})
+	if !errors.Is(err, boom) || lineError(t, err).Line != 1 {
+		t.Errorf("failing transform gave %v", err)
+	}
+	_, _, err = convertString("1:1\n", nil, Options{Transform: func(string) (string, error) { return "2", nil }})
+	if !errors.Is(err, ErrInvalidBinary) {
+		t.Errorf("invalid transformed bits gave %v", err)
+	}
+}
+
+// Checks that Follow keeps converting lines appended to the input until canceled
+func TestFollow(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	f, err := os.Create(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString("2:1011\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type result struct {
+		summary Summary
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		summary, err := ConvertFileContext(ctx, in, out, nil, Options{Follow: true, LineWorkers: 4})
+		done <- result{summary, err}
+	}()
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if got, _ := os.ReadFile(out); string(got) == want {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		got, _ := os.ReadFile(out)
+		t.Fatalf("output %q, want %q", got, want)
+	}
+	waitFor("2:B0.4\n")
+	f.WriteString("3:101\n1:")
+	waitFor("2:B0.4\n3:A0.3\n")
+	time.Sleep(2 * followInterval)
+	waitFor("2:B0.4\n3:A0.3\n")
+	f.WriteString("1\n")
+	waitFor("2:B0.4\n3:A0.3\n1:80.1\n")
+	cancel()
+	select {
+	case r := <-done:
+		if !errors.Is(r.err, context.Canceled) || r.summary.Lines != 3 {
+			t.Errorf("follow ended with %v after %d lines", r.err, r.summary.Lines)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("follow did not stop")
+	}
+}
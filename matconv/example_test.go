@@ -0,0 +1,44 @@
+package matconv_test
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Com4n/task5/matconv"
+)
+
+func ExampleBinToHex() {
+	hex, err := matconv.BinToHex("10110")
+	if err != nil {
+		panic(err)
+	}
+	bin, _ := matconv.HexToBin(hex)
+	fmt.Println(hex, bin)
+	// Output: B0.5 10110
+}
+
+func ExampleConvert() {
+	in := strings.NewReader("2x2:1011\n2x4:10110011\n")
+	cache := matconv.NewCache[string](100)
+	summary, err := matconv.Convert(in, os.Stdout, cache, matconv.Options{Direction: matconv.Compress})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(summary.Lines, "lines")
+	// Output:
+	// 2x2:B0.4
+	// 2x4:B3
+	// 2 lines
+}
+
+func ExampleCache() {
+	cache := matconv.NewCache[string](2)
+	cache.Set("a", "1")
+	cache.Set("b", "2")
+	cache.Get("a")
+	cache.Set("c", "3") // evicts b, the least recently used
+	_, ok := cache.Get("b")
+	fmt.Println(cache.Keys(), ok, cache.Stats().Hits)
+	// Output: [a c] false 1
+}
@@ -0,0 +1,85 @@
+package matconv
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// headerPrefix starts the optional header line describing how values were encoded
+const headerPrefix = "#"
+
+// Separators of the header fields, e.g. "#format=hex;delim=:;bitorder=msb"
+const (
+	headerFieldSep = ";"
+	headerValueSep = "="
+)
+
+// Percent-escape the separators in header values, so that e.g. a ";" delimiter can be read back
+var (
+	headerEscaper   = strings.NewReplacer("%", "%25", headerFieldSep, "%3B", headerValueSep, "%3D")
+	headerUnescaper = strings.NewReplacer("%25", "%", "%3B", headerFieldSep, "%3D", headerValueSep)
+)
+
+// Formats the header line for output compressed with opts
+func formatHeader(opts Options) string {
+	format := opts.Format
+	if format == "" {
+		format = FormatHex
+	}
+	bitOrder := "msb"
+	if opts.LSBFirst {
+		bitOrder = "lsb"
+	}
+	fields := []string{
+		"format" + headerValueSep + format,
+		"delim" + headerValueSep + headerEscaper.Replace(opts.outputDelimiter()),
+		"bitorder" + headerValueSep + bitOrder,
+		"align" + headerValueSep + strconv.Itoa(opts.align()),
+		"checksum" + headerValueSep + strconv.FormatBool(opts.Checksum),
+	}
+	return headerPrefix + strings.Join(fields, headerFieldSep)
+}
+
+// Applies the settings of a header line to opts. Unknown fields are ignored so that
+// newer headers can still be read.
+func applyHeader(line string, opts Options) (Options, error) {
+	fields := strings.TrimPrefix(line, headerPrefix)
+	for _, field := range strings.Split(fields, headerFieldSep) {
+		key, value, found := strings.Cut(field, headerValueSep)
+		if !found {
+			return opts, fmt.Errorf("malformed header field %q", field)
+		}
+		var err error
+		switch key {
+		case "format":
+			if !slices.Contains(Formats, value) {
+				err = fmt.Errorf("unknown format %q", value)
+			}
+			opts.Format = value
+		case "delim":
+			if value == "" {
+				err = errors.New("empty delimiter")
+			}
+			opts.Delimiter = headerUnescaper.Replace(value)
+		case "bitorder":
+			if value != "msb" && value != "lsb" {
+				err = fmt.Errorf("unknown bit order %q", value)
+			}
+			opts.LSBFirst = value == "lsb"
+		case "align":
+			opts.Align, err = strconv.Atoi(value)
+			if err == nil && opts.Align < 1 {
+				err = fmt.Errorf("invalid alignment %d", opts.Align)
+			}
+		case "checksum":
+			opts.Checksum, err = strconv.ParseBool(value)
+		}
+		if err != nil {
+			return opts, fmt.Errorf("header %s: %w", key, err)
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,325 @@
+package matconv
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// FormatRaw is the Options.Format of raw binary files. Unlike the value encodings in
+// Formats it changes the whole output: compression writes each line as a binary
+// record instead of text, and decompression reads such records back into lines.
+const FormatRaw = "raw"
+
+// rawMagic starts every raw file. The leading NUL never appears in a text input, so
+// Auto can tell raw input from text by its first bytes.
+const rawMagic = "\x00MCRAW\x01"
+
+// Raw record layout: the size field as a uvarint length and its bytes, then the bit
+// count as a uvarint and the (bits+7)/8 packed bytes, so no value carries padding
+// or a recorded bit length.
+
+// RawWriter writes matrixSize:binary lines as raw records
+type RawWriter struct {
+	w       *bufio.Writer
+	opts    Options
+	started bool
+}
+
+// NewRawWriter returns a RawWriter packing bits in the order opts.LSBFirst selects. The
+// magic is written before the first record, so an empty input gives an empty file.
+func NewRawWriter(w io.Writer, opts Options) *RawWriter {
+	return &RawWriter{w: bufio.NewWriter(w), opts: opts}
+}
+
+// WriteLine parses a matrixSize:binary line and writes it as one record. Lines with
+// fields after the value are rejected, since records only hold the size and the bits.
+func (w *RawWriter) WriteLine(line string) error {
+	matrixSize, value, err := w.parse(line)
+	if err != nil {
+		return err
+	}
+	return w.write(matrixSize, value)
+}
+
+// Splits a line into its size and binary value, checking both as opts describes
+func (w *RawWriter) parse(line string) (matrixSize, value string, err error) {
+	if err := checkASCII(line); err != nil {
+		return "", "", err
+	}
+	delim := w.opts.delimiter()
+	matrixSize, value, found := strings.Cut(line, delim)
+	if !found {
+		return "", "", fmt.Errorf("%w %q: missing %q separator", ErrMalformedLine, line, delim)
+	}
+	if strings.Contains(value, delim) {
+		return "", "", fmt.Errorf("%w %q: raw records cannot hold fields after the value", ErrMalformedLine, line)
+	}
+	if w.opts.TrimSpace {
+		matrixSize, value = strings.TrimSpace(matrixSize), strings.TrimSpace(value)
+	}
+	if err := validateBits(value); err != nil {
+		return "", "", err
+	}
+	if w.opts.ValidateSize {
+		if err := checkMatrixSize(matrixSize, len(value)); err != nil {
+			return "", "", err
+		}
+	}
+	if w.opts.Transform != nil {
+		if value, err = w.opts.Transform(value); err != nil {
+			return "", "", err
+		}
+		if err := validateBits(value); err != nil {
+			return "", "", fmt.Errorf("transformed value: %w", err)
+		}
+	}
+	return matrixSize, value, nil
+}
+
+// Writes one record, preceded by the magic if it is the first
+func (w *RawWriter) write(matrixSize, value string) error {
+	if !w.started {
+		w.w.WriteString(rawMagic)
+		w.started = true
+	}
+	w.w.Write(binary.AppendUvarint(nil, uint64(len(matrixSize))))
+	w.w.WriteString(matrixSize)
+	w.w.Write(binary.AppendUvarint(nil, uint64(len(value))))
+	_, err := w.w.Write(packBits(value, w.opts.LSBFirst))
+	return err
+}
+
+// Flush writes any buffered records to the underlying writer
+func (w *RawWriter) Flush() error {
+	return w.w.Flush()
+}
+
+// RawReader reads the records of a raw file back into matrixSize:binary lines
+type RawReader struct {
+	r       *bufio.Reader
+	opts    Options
+	started bool
+	limit   int
+}
+
+// NewRawReader returns a RawReader unpacking bits in the order opts.LSBFirst selects.
+// Size fields and packed values longer than opts.MaxLineSize bytes, or the 64KiB
+// default, are rejected as corrupt.
+func NewRawReader(r io.Reader, opts Options) *RawReader {
+	limit := opts.MaxLineSize
+	if limit <= 0 {
+		limit = bufio.MaxScanTokenSize
+	}
+	return &RawReader{r: bufio.NewReader(r), opts: opts, limit: limit}
+}
+
+// ReadLine returns the next record as a line joined by the output delimiter, without a
+// line ending. It returns io.EOF after the last record; a file cut short within a record
+// gives io.ErrUnexpectedEOF. Options.ValidateSize is not applied.
+func (r *RawReader) ReadLine() (string, error) {
+	matrixSize, value, err := r.next()
+	if err != nil {
+		return "", err
+	}
+	return matrixSize + r.opts.outputDelimiter() + value, nil
+}
+
+// Reads the next record as its size field and binary value
+func (r *RawReader) next() (matrixSize, value string, err error) {
+	if !r.started {
+		magic := make([]byte, len(rawMagic))
+		if _, err := io.ReadFull(r.r, magic); err != nil {
+			if err == io.EOF {
+				return "", "", err
+			}
+			return "", "", errors.New("input is not a raw file: too short")
+		}
+		if string(magic) != rawMagic {
+			return "", "", errors.New("input is not a raw file: missing raw magic")
+		}
+		r.started = true
+	}
+	sizeLen, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return "", "", err
+	}
+	if sizeLen > uint64(r.limit) {
+		return "", "", fmt.Errorf("raw size field of %d bytes exceeds the %d byte limit", sizeLen, r.limit)
+	}
+	size := make([]byte, sizeLen)
+	if _, err := io.ReadFull(r.r, size); err != nil {
+		return "", "", unexpectedEOF(err)
+	}
+	bits, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return "", "", unexpectedEOF(err)
+	}
+	if bits > 8*uint64(r.limit) {
+		return "", "", fmt.Errorf("raw value of %d bits exceeds the %d byte limit", bits, r.limit)
+	}
+	packed := make([]byte, (bits+7)/8)
+	if _, err := io.ReadFull(r.r, packed); err != nil {
+		return "", "", unexpectedEOF(err)
+	}
+	value = unpackBits(packed, int(bits), r.opts.LSBFirst)
+	if r.opts.InverseTransform != nil {
+		if value, err = r.opts.InverseTransform(value); err != nil {
+			return "", "", err
+		}
+	}
+	return string(size), value, nil
+}
+
+// Reports an EOF inside a record as io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// rawInput reports whether the buffered input starts with the raw magic
+func rawInput(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(rawMagic))
+	return string(magic) == rawMagic
+}
+
+// Converts between text lines and a raw file for ConvertContext: compression writes the
+// lines of r as records, decompression writes the records of r as lines, and Auto picks
+// by whether r starts with the raw magic. The cache, LineWorkers and Header are not used.
+func convertRaw(ctx context.Context, r io.Reader, w io.Writer, opts Options) (Summary, error) {
+	var summary Summary
+	if err := opts.checkDelimiters(); err != nil {
+		return summary, err
+	}
+	reader := bufio.NewReader(countingReader{r, &summary.InputBytes})
+	w = countingWriter{w, &summary.OutputBytes}
+	if opts.Progress != nil {
+		defer func() { opts.Progress(summary.Lines % progressInterval) }()
+	}
+
+	// done counts a converted line, or handles the error of line number num
+	done := func(num int, offset int64, line string, err error) error {
+		if err != nil {
+			summary.Errors++
+			err = &LineError{Line: num, Offset: offset, Content: line, Err: err}
+			if !opts.SkipErrors {
+				return err
+			}
+			if opts.OnSkip != nil {
+				opts.OnSkip(err)
+			}
+			return nil
+		}
+		summary.Lines++
+		if opts.Progress != nil && summary.Lines%progressInterval == 0 {
+			opts.Progress(progressInterval)
+		}
+		if summary.Lines == opts.Limit {
+			return errLimitReached
+		}
+		return nil
+	}
+
+	var err error
+	if opts.Direction == Decompress || (opts.Direction == Auto && rawInput(reader)) {
+		err = decompressRaw(ctx, NewRawReader(reader, opts), w, opts, done)
+	} else {
+		err = compressRaw(ctx, reader, NewRawWriter(w, opts), opts, done)
+	}
+	return summary, err
+}
+
+// Flushes the output at the end of a raw conversion that ended with err, mirroring
+// ConvertContext: reaching Options.Limit is a success, and the records converted before
+// a cancellation or a corrupt record are kept
+func finishRaw(ctx context.Context, err error, flush func() error) error {
+	if err == errLimitReached {
+		return flush()
+	}
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, errCorruptRecord) {
+			flush()
+		}
+		return err
+	}
+	return flush()
+}
+
+// errCorruptRecord marks a raw record that cannot be read, after which decompressRaw
+// stops but keeps the records before it
+var errCorruptRecord = errors.New("corrupt raw record")
+
+// Writes the lines of r as raw records, flushing them once the input ends or ctx
+// is canceled
+func compressRaw(ctx context.Context, r io.Reader, w *RawWriter, opts Options, done func(int, int64, string, error) error) error {
+	scanner := newScanner(r, opts)
+	offsets := lineOffsets{inner: opts.Split}
+	scanner.Split(offsets.split)
+	var err error
+	for lineNum := 1; err == nil; lineNum++ {
+		if lineNum%cancelCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+		}
+		if !scanner.Scan() {
+			if err = scanner.Err(); err != nil {
+				err = scanError(err, opts)
+			}
+			break
+		}
+		line := scanner.Text()
+		if opts.ignored(line) {
+			continue
+		}
+		matrixSize, value, lineErr := w.parse(line)
+		if lineErr == nil {
+			if err = w.write(matrixSize, value); err != nil {
+				break
+			}
+		}
+		err = done(lineNum, offsets.start, line, lineErr)
+	}
+	return finishRaw(ctx, err, w.Flush)
+}
+
+// Writes the raw records of r as text lines. A malformed record ends the conversion
+// even with SkipErrors, since the records after it cannot be found; the lines of the
+// records before it are still written.
+func decompressRaw(ctx context.Context, r *RawReader, w io.Writer, opts Options, done func(int, int64, string, error) error) error {
+	writer := bufio.NewWriter(w)
+	lineEnding := opts.lineEnding()
+	var err error
+	for lineNum := 1; err == nil; lineNum++ {
+		if lineNum%cancelCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+		}
+		matrixSize, value, readErr := r.next()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			err = &LineError{Line: lineNum, Offset: -1, Err: fmt.Errorf("%w: %w", errCorruptRecord, readErr)}
+			break
+		}
+		line := matrixSize + opts.outputDelimiter() + value
+		if opts.ValidateSize {
+			if lineErr := checkMatrixSize(matrixSize, len(value)); lineErr != nil {
+				err = done(lineNum, -1, line, lineErr)
+				continue
+			}
+		}
+		if _, err = writer.WriteString(line + lineEnding); err == nil {
+			err = done(lineNum, -1, line, nil)
+		}
+	}
+	return finishRaw(ctx, err, writer.Flush)
+}
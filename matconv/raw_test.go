@@ -0,0 +1,127 @@
+package matconv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// compressRawString converts in to a raw file and returns its bytes
+func compressRawString(t *testing.T, in string, opts Options) []byte {
+	t.Helper()
+	opts.Format = FormatRaw
+	var raw bytes.Buffer
+	if _, err := Convert(strings.NewReader(in), &raw, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	return raw.Bytes()
+}
+
+// Checks that raw files decode back to their lines in each direction and bit order
+func TestRawRoundTrip(t *testing.T) {
+	in := "2:1011\n3x3:101010101\n10:\n1:1\n"
+	for _, lsb := range []bool{false, true} {
+		for _, dir := range []Direction{Decompress, Auto} {
+			opts := Options{Format: FormatRaw, LSBFirst: lsb}
+			raw := compressRawString(t, in, opts)
+			if !bytes.HasPrefix(raw, []byte(rawMagic)) {
+				t.Fatalf("raw output starts with %q", raw[:min(len(raw), len(rawMagic))])
+			}
+			opts.Direction = dir
+			var out strings.Builder
+			summary, err := Convert(bytes.NewReader(raw), &out, nil, opts)
+			if err != nil || out.String() != in || summary.Lines != 4 || summary.InputBytes != int64(len(raw)) {
+				t.Errorf("lsb=%v dir=%v: got %q, %+v, %v", lsb, dir, out.String(), summary, err)
+			}
+		}
+	}
+}
+
+// Checks that RawReader returns each record as a line, then io.EOF
+func TestRawReader(t *testing.T) {
+	in := "2:1011\n3x3:101010101\n1:1\n"
+	r := NewRawReader(bytes.NewReader(compressRawString(t, in, Options{})), Options{})
+	var lines []string
+	for {
+		line, err := r.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if got := strings.Join(lines, "\n") + "\n"; got != in {
+		t.Errorf("read %q, want %q", got, in)
+	}
+}
+
+// Checks that a raw file cut short keeps the records before the cut
+func TestRawTruncated(t *testing.T) {
+	var in strings.Builder
+	for i := 0; i < 25; i++ {
+		fmt.Fprintf(&in, "8:%08b\n", i)
+	}
+	raw := compressRawString(t, in.String(), Options{})
+	for _, workers := range []int{1, 3} {
+		var out strings.Builder
+		summary, err := Convert(bytes.NewReader(raw[:len(raw)-1]), &out, nil, Options{Format: FormatRaw, Direction: Decompress, SkipErrors: true, LineWorkers: workers})
+		if !errors.Is(err, io.ErrUnexpectedEOF) || lineError(t, err).Line != 25 {
+			t.Fatalf("workers=%d: truncated file gave %v", workers, err)
+		}
+		want := strings.Join(strings.SplitAfter(in.String(), "\n")[:24], "")
+		if out.String() != want || summary.Lines != 24 {
+			t.Errorf("workers=%d: kept %d lines, %q", workers, summary.Lines, out.String())
+		}
+	}
+}
+
+// Checks the lines and inputs raw conversion rejects
+func TestRawErrors(t *testing.T) {
+	_, summary, err := convertString("2:1011\nbad\n2:10:x\n1:1\n", nil, Options{Format: FormatRaw, SkipErrors: true})
+	if err != nil || summary.Lines != 2 || summary.Errors != 2 {
+		t.Errorf("skipping bad lines gave %+v, %v", summary, err)
+	}
+	_, _, err = convertString("text\n", nil, Options{Format: FormatRaw, Direction: Decompress})
+	if err == nil || !strings.Contains(err.Error(), "not a raw file") {
+		t.Errorf("text input gave %v", err)
+	}
+}
+
+// Checks that an empty input gives an empty raw file and that Limit stops early
+func TestRawLimit(t *testing.T) {
+	if out, summary, err := convertString("", nil, Options{Format: FormatRaw}); err != nil || out != "" || summary.Lines != 0 {
+		t.Errorf("empty input gave %q, %v", out, err)
+	}
+	if _, summary, err := convertString("1:1\n1:0\n1:1\n", nil, Options{Format: FormatRaw, Limit: 2}); err != nil || summary.Lines != 2 {
+		t.Errorf("Limit 2 gave %+v, %v", summary, err)
+	}
+}
+
+// Checks that raw records are about half the size of hex lines
+func TestRawSize(t *testing.T) {
+	in := "100x100:" + strings.Repeat("10", 5000) + "\n"
+	raw := compressRawString(t, in, Options{})
+	hex, _, _ := convertString(in, nil, Options{})
+	if len(raw) > len(hex)/2+30 {
+		t.Errorf("raw is %d bytes, hex %d", len(raw), len(hex))
+	}
+}
+
+// Checks that the transform hooks apply to raw records
+func TestRawTransform(t *testing.T) {
+	invert := func(bits string) (string, error) {
+		return strings.Map(func(r rune) rune { return '0' + '1' - r }, bits), nil
+	}
+	opts := Options{Transform: invert, InverseTransform: invert}
+	raw := compressRawString(t, "2:1100\n3:100\n", opts)
+	var out strings.Builder
+	opts.Format, opts.Direction = FormatRaw, Decompress
+	if _, err := Convert(bytes.NewReader(raw), &out, nil, opts); err != nil || out.String() != "2:1100\n3:100\n" {
+		t.Errorf("got %q, %v", out.String(), err)
+	}
+}